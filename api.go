@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/FlashpointProject/zipfs"
+)
+
+// Routes served under the api prefix, alongside the zipfs mount routes
+var apiRoutes = map[string]http.HandlerFunc{
+	"settings":  serveSettingsApi,
+	"profile":   serveProfileApi,
+	"health":    serveHealthApi,
+	"sockets":   serveSocketsApi,
+	"proxy.pac": servePacApi,
+}
+
+// Response for a settings change
+type settingsPatchResponse struct {
+	Message         string         `json:"msg"`
+	Changed         []string       `json:"changed"`
+	RestartRequired []string       `json:"restartRequired"`
+	Persisted       bool           `json:"persisted"`
+	Errors          SettingsErrors `json:"errors,omitempty"`
+}
+
+// Routes under the api prefix that zipfs serves itself
+var zipApiRoutes = []string{"mountzip", "unmountzip", "listmountzip"}
+
+// Serves the api routes, passing the zipfs routes through to zipServer. Nothing else is served, game
+// content is only reachable through the proxy.
+func newApiHandler(apiPrefix string, zipServer http.Handler) http.Handler {
+	basePath := path.Join("/", strings.ToLower(apiPrefix))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urlPath := path.Join("/", strings.ToLower(r.URL.Path))
+		for name, handler := range apiRoutes {
+			if urlPath == path.Join(basePath, name) {
+				handler(w, r)
+				return
+			}
+		}
+		for _, name := range zipApiRoutes {
+			if urlPath == path.Join(basePath, name) {
+				zipServer.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
+
+func writeJsonResponse(w http.ResponseWriter, data interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		fmt.Printf("Error writing API response: %s\n", err)
+	}
+}
+
+// Checks a request that changes the proxy's state came from the launcher rather than a web page,
+// writing an error and returning false if it didn't. Any page can send requests to the api, but
+// browsers add its Origin, and can only send json bodies after a preflight that isn't answered.
+func checkApiRequest(w http.ResponseWriter, r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		originURL, err := url.Parse(origin)
+		if err != nil || !isLocalHost(originURL.Hostname()) {
+			fmt.Printf("Error (API): refused %s %s from %s\n", r.Method, r.URL.Path, origin)
+			writeJsonResponse(w, zipfs.SimpleResponseData{Message: "Requests from web pages are not allowed."}, http.StatusForbidden)
+			return false
+		}
+	}
+	if r.Method == "POST" || r.Method == "PATCH" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			writeJsonResponse(w, zipfs.SimpleResponseData{Message: "Content-Type must be application/json."}, http.StatusUnsupportedMediaType)
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether a host is the local machine
+func isLocalHost(host string) bool {
+	host = strings.Trim(strings.ToLower(host), "[]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// GET returns the live settings, including the active profile. PATCH applies the given settings on
+// top of the base settings, with ?persist=true also saving them to the user settings file so they
+// survive a restart.
+func serveSettingsApi(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJsonResponse(w, currentSettings(), http.StatusOK)
+	case "PATCH":
+		if !checkApiRequest(w, r) {
+			return
+		}
+		patch := map[string]json.RawMessage{}
+		err := json.NewDecoder(r.Body).Decode(&patch)
+		if err != nil {
+			fmt.Printf("Error (Settings API): %s\n", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		persist := r.URL.Query().Get("persist") == "true"
+		response, status := patchSettings(patch, persist)
+		writeJsonResponse(w, response, status)
+	default:
+		http.Error(w, "GET or PATCH request expected.", http.StatusMethodNotAllowed)
+	}
+}
+
+// Applies a partial set of settings on top of the live settings. Unless persisted, the
+// changes last until the settings files are next reloaded.
+func patchSettings(patch map[string]json.RawMessage, persist bool) (*settingsPatchResponse, int) {
+	settingsReloadMutex.Lock()
+	defer settingsReloadMutex.Unlock()
+
+	current, err := structLayer("current", baseSettings())
+	if err != nil {
+		return &settingsPatchResponse{Message: err.Error()}, http.StatusInternalServerError
+	}
+	patchLayer := &settingsLayer{name: "api", values: patch}
+	problems := validateSettingsLayers([]*settingsLayer{patchLayer})
+	newSettings, _, err := mergeSettingsLayers([]*settingsLayer{current, patchLayer})
+	if err != nil {
+		return &settingsPatchResponse{Message: err.Error()}, http.StatusBadRequest
+	}
+	err = resolveSettingsPaths(newSettings)
+	if err != nil {
+		return &settingsPatchResponse{Message: err.Error()}, http.StatusBadRequest
+	}
+	problems = append(problems, validateSettings(newSettings)...)
+	if len(problems) > 0 {
+		return &settingsPatchResponse{Message: "Invalid settings", Errors: problems}, http.StatusBadRequest
+	}
+
+	if persist {
+		err = persistUserSettings(patch)
+		if err != nil {
+			fmt.Printf("Error (Settings API): failed to save user settings: %s\n", err)
+			return &settingsPatchResponse{Message: err.Error()}, http.StatusInternalServerError
+		}
+	}
+	changed, restartRequired := swapSettings(newSettings)
+	return &settingsPatchResponse{
+		Message:         "Settings updated!",
+		Changed:         changed,
+		RestartRequired: restartRequired,
+		Persisted:       persist,
+	}, http.StatusOK
+}
+
+// Writes settings into the user settings file, keeping anything else already in it
+func persistUserSettings(values map[string]json.RawMessage) error {
+	userLayer, err := fileSettingsLayer("user", userSettingsFilePath(), false)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		field, _ := settingStructField(key)
+		existing, exists := userLayer.values[key]
+		if exists && field.Type.Kind() == reflect.Map && string(value) != "null" {
+			value, err = mergeJSONObjects(existing, value)
+			if err != nil {
+				return err
+			}
+		}
+		userLayer.values[key] = value
+	}
+	data, err := json.MarshalIndent(userLayer.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(userSettingsFilePath(), data, 0644)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func setupTestApi(t *testing.T) http.Handler {
+	setupTestInstall(t)
+	writeTestSettingsFile(t, `{"rootPath": "`+jsonEscape(cwd)+`", "extMimeTypes": {"swf": "application/x-shockwave-flash"}}`)
+	settings, _, err := loadServerSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeSettings(settings)
+	return newApiHandler("fpProxy/api/", http.NotFoundHandler())
+}
+
+// Makes an api request with a json body, as the launcher sends them
+func makeJsonRequest(method string, url string, body io.Reader) *http.Request {
+	r := makeNewRequest(method, url, body)
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func jsonEscape(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data[1 : len(data)-1])
+}
+
+func TestSettingsApiGet(t *testing.T) {
+	handler := setupTestApi(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, makeNewRequest("GET", "http://127.0.0.1/fpProxy/api/settings", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", w.Code)
+	}
+	settings := ServerSettings{}
+	err := json.Unmarshal(w.Body.Bytes(), &settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.ExtMimeTypes["swf"] != "application/x-shockwave-flash" {
+		t.Errorf("expected live settings, got %v", settings.ExtMimeTypes)
+	}
+}
+
+func TestSettingsApiPatch(t *testing.T) {
+	handler := setupTestApi(t)
+
+	body := bytes.NewBufferString(`{"useMad4FP": true, "proxyPort": "22700", "extMimeTypes": {"dcr": "application/x-director"}}`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, makeJsonRequest("PATCH", "http://127.0.0.1/fpProxy/api/settings?persist=true", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	response := settingsPatchResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.RestartRequired) != 1 || response.RestartRequired[0] != "proxyPort" {
+		t.Errorf("expected proxyPort to need a restart, got %v", response.RestartRequired)
+	}
+
+	settings := currentSettings()
+	if !settings.UseMad4FP {
+		t.Error("expected useMad4FP to be enabled")
+	}
+	if settings.ExtMimeTypes["swf"] == "" || settings.ExtMimeTypes["dcr"] == "" {
+		t.Errorf("expected mime types to be merged, got %v", settings.ExtMimeTypes)
+	}
+
+	// Persisted to the user settings file
+	data, err := os.ReadFile(userSettingsFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := map[string]interface{}{}
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved["useMad4FP"] != true || saved["proxyPort"] != "22700" {
+		t.Errorf("expected patch to be saved, got %s", data)
+	}
+}
+
+func TestSettingsApiPatchInvalid(t *testing.T) {
+	handler := setupTestApi(t)
+	before := currentSettings()
+
+	body := bytes.NewBufferString(`{"useMad4FP": "yes", "extMimeTypes": {"dcr": "not a mime"}}`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, makeJsonRequest("PATCH", "http://127.0.0.1/fpProxy/api/settings", body))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, got %d", w.Code)
+	}
+	response := settingsPatchResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Errors) != 2 {
+		t.Errorf("expected 2 errors, got %v", response.Errors)
+	}
+	if currentSettings() != before {
+		t.Error("expected settings to be left unchanged")
+	}
+}
+
+func TestSettingsApiRefusesWebPages(t *testing.T) {
+	handler := setupTestApi(t)
+
+	r := makeJsonRequest("PATCH", "http://127.0.0.1/fpProxy/api/settings?persist=true", bytes.NewBufferString(`{"useMad4FP": true}`))
+	r.Header.Set("Origin", "http://attacker.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status code 403 for a foreign origin, got %d", w.Code)
+	}
+
+	r = makeNewRequest("PATCH", "http://127.0.0.1/fpProxy/api/settings", bytes.NewBufferString(`{"useMad4FP": true}`))
+	r.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status code 415 for a body that isn't json, got %d", w.Code)
+	}
+	if currentSettings().UseMad4FP {
+		t.Error("expected refused requests to leave the settings unchanged")
+	}
+
+	r = makeJsonRequest("PATCH", "http://127.0.0.1/fpProxy/api/settings", bytes.NewBufferString(`{"useMad4FP": true}`))
+	r.Header.Set("Origin", "http://localhost:3000")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code 200 for a local origin, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiHandlerServesOnlyApi(t *testing.T) {
+	served := []string{}
+	handler := newApiHandler("fpProxy/api/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = append(served, r.URL.Path)
+	}))
+
+	for _, url := range []string{"http://127.0.0.1/fpProxy/api/mountzip", "http://127.0.0.1/fpProxy/api/listmountzip", "http://127.0.0.1/content/example.com/game.swf", "http://127.0.0.1/fpProxy/api/other"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, makeNewRequest("GET", url, nil))
+	}
+	if !reflect.DeepEqual(served, []string{"/fpProxy/api/mountzip", "/fpProxy/api/listmountzip"}) {
+		t.Errorf("expected only the zipfs api to reach the zip server, got %v", served)
+	}
+}
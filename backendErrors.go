@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the backends a request can fail on, used in the X-Fpproxy-Backend header and health
+// reports. Content sources are reported by the name they have in the chain.
+const (
+	backendGameZip        = "zip"
+	backendExternalLegacy = "external"
+)
+
+// Failure counts for a single backend. A backend is healthy again once it succeeds after failing.
+type backendHealth struct {
+	Healthy     bool      `json:"healthy"`
+	Failures    int64     `json:"failures"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastFailure time.Time `json:"lastFailure,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+}
+
+var backendHealthMutex sync.Mutex
+var backendHealthStats = map[string]*backendHealth{}
+
+// Counts a failure against a backend
+func recordBackendFailure(backend string, err error) {
+	backendHealthMutex.Lock()
+	defer backendHealthMutex.Unlock()
+	health, ok := backendHealthStats[backend]
+	if !ok {
+		health = &backendHealth{}
+		backendHealthStats[backend] = health
+	}
+	health.Healthy = false
+	health.Failures++
+	health.LastError = err.Error()
+	health.LastFailure = time.Now()
+}
+
+// Marks a backend as healthy again after a success, backends that never failed aren't tracked
+func recordBackendSuccess(backend string) {
+	backendHealthMutex.Lock()
+	defer backendHealthMutex.Unlock()
+	health, ok := backendHealthStats[backend]
+	if !ok || health.Healthy {
+		return
+	}
+	health.Healthy = true
+	health.LastSuccess = time.Now()
+	fmt.Printf("[Health] %s recovered after %d failures\n", backend, health.Failures)
+}
+
+// Returns a copy of the failure counts for every backend that has failed
+func backendHealthReport() map[string]backendHealth {
+	backendHealthMutex.Lock()
+	defer backendHealthMutex.Unlock()
+	report := map[string]backendHealth{}
+	for backend, health := range backendHealthStats {
+		report[backend] = *health
+	}
+	return report
+}
+
+// Builds a 502, or a 504 for timeouts, explaining which backend failed and why
+func backendErrorResponse(r *http.Request, backend string, err error) *http.Response {
+	recordBackendFailure(backend, err)
+	status := http.StatusBadGateway
+	if isTimeout(err) {
+		status = http.StatusGatewayTimeout
+	}
+	fmt.Printf("[%s] %d %s: %s\n", backend, status, r.URL, err)
+
+	// Header values can't hold newlines
+	reason := strings.Join(strings.Fields(err.Error()), " ")
+	body := fmt.Sprintf("%d %s\n\nBackend: %s\nURL: %s\nError: %s\n", status, http.StatusText(status), backend, r.URL, reason)
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Set("X-Fpproxy-Backend", backend)
+	resp.Header.Set("X-Fpproxy-Error", reason)
+	return resp
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// GET returns the failure counts of each backend and online mirror
+func serveHealthApi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET request expected.", http.StatusMethodNotAllowed)
+		return
+	}
+	report := backendHealthReport()
+	healthy := true
+	for _, health := range report {
+		healthy = healthy && health.Healthy
+	}
+	writeJsonResponse(w, map[string]interface{}{
+		"healthy":  healthy,
+		"backends": report,
+		"mirrors":  mirrorHealthReport(),
+	}, http.StatusOK)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/** Compression
+ * Files in htdocs and GameZIPs can have pre-compressed copies next to them, e.g. game.js.br and
+ * game.js.gz beside game.js, which are served instead when the client's Accept-Encoding allows it,
+ * Brotli first. Nothing is ever Brotli encoded by the proxy itself.
+ * With compressResponses on, other responses of compressMimeTypes are gzipped as they're sent when
+ * they're at least compressMinSize bytes, or of unknown size. Range requests are left uncompressed
+ * so they can still be answered.
+ * Gzip encoded responses, such as .svgz files or gzip sidecars, are decompressed for clients that
+ * don't accept gzip. Old plugins often send no Accept-Encoding at all, so that's taken to mean
+ * only uncompressed bodies are understood. A part of a gzip stream can't be decompressed, so
+ * Range requests for extGzippedTypes files from those clients are answered with the whole file.
+ * Every response that depends on Accept-Encoding is given Vary: Accept-Encoding. GameZIP sidecars
+ * are only looked up for codings the client accepts, so a GameZIP file's response only varies
+ * once a sidecar the client accepts has been found.
+ */
+
+// Pre-compressed sidecar extensions and their encodings, in order of preference
+var sidecarEncodings = []struct {
+	ext    string
+	coding string
+}{
+	{".br", "br"},
+	{".gz", "gzip"},
+}
+
+// Returns whether the client accepts a content coding, going by Accept-Encoding and its q-values
+func acceptsEncoding(r *http.Request, coding string) bool {
+	accepted := false
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		if name != coding && name != "*" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			// An invalid q-value is read as 0, refusing the coding
+			q, _ = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+		}
+		if name == coding {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// Adds a header name to Vary, unless it's already there
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, existing := range strings.Split(value, ",") {
+			existing = strings.TrimSpace(existing)
+			if existing == "*" || strings.EqualFold(existing, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// Returns whether a file path could have sidecars, it mustn't be a directory or compressed itself
+func canHaveSidecar(filePath string) bool {
+	if filePath == "" || strings.HasSuffix(filePath, "/") {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(filePath))
+	for _, sidecar := range sidecarEncodings {
+		if ext == sidecar.ext {
+			return false
+		}
+	}
+	return true
+}
+
+// Finds the pre-compressed copies of a local file. found is whether there are any, and coding is
+// set when one of them is accepted by the client.
+func findSidecarFile(r *http.Request, filePath string) (found bool, sidecarPath string, stats os.FileInfo, coding string) {
+	if !canHaveSidecar(filePath) {
+		return false, "", nil, ""
+	}
+	for _, sidecar := range sidecarEncodings {
+		sidecarStats, err := os.Stat(filePath + sidecar.ext)
+		if err != nil || sidecarStats.IsDir() {
+			continue
+		}
+		found = true
+		if acceptsEncoding(r, sidecar.coding) {
+			return true, filePath + sidecar.ext, sidecarStats, sidecar.coding
+		}
+	}
+	return found, "", nil, ""
+}
+
+// Swaps a zip server response for a pre-compressed copy of the same file when the client accepts
+// one, zipRequest being the request the response was for. Each lookup is a zip server request, so
+// only accepted codings are looked up, stopping at the first found.
+func serveZipSidecar(zipRequest *http.Request, resp *http.Response) *http.Response {
+	if (zipRequest.Method != "GET" && zipRequest.Method != "HEAD") || !canHaveSidecar(zipRequest.URL.Path) {
+		return resp
+	}
+	for _, sidecar := range sidecarEncodings {
+		if !acceptsEncoding(zipRequest, sidecar.coding) {
+			continue
+		}
+		sidecarRequest := zipRequest.Clone(zipRequest.Context())
+		sidecarRequest.URL.Path += sidecar.ext
+		sidecarResp := serveInProcess(zipServer, sidecarRequest)
+		if sidecarResp.StatusCode == http.StatusNotFound {
+			sidecarResp.Body.Close()
+			continue
+		}
+		addVary(resp.Header, "Accept-Encoding")
+		if sidecarResp.StatusCode >= 400 {
+			sidecarResp.Body.Close()
+			return resp
+		}
+		resp.Body.Close()
+		sidecarResp.Header.Set("Content-Encoding", sidecar.coding)
+		// Keep the original's name, so the content type comes from its extension
+		sidecarResp.Header.Set("ZIPSVR_FILENAME", resp.Header.Get("ZIPSVR_FILENAME"))
+		if sidecarResp.Header.Get("ZIPSVR_FILENAME") == "" {
+			sidecarResp.Header.Del("ZIPSVR_FILENAME")
+		}
+		addVary(sidecarResp.Header, "Accept-Encoding")
+		return sidecarResp
+	}
+	return resp
+}
+
+// Returns whether a content type should be compressed on the fly
+func isCompressibleType(settings *ServerSettings, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range settings.CompressMimeTypes {
+		if matched, _ := path.Match(strings.ToLower(pattern), mediaType); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Fits the response's encoding to what the client accepts, decompressing or compressing the body
+func negotiateContentEncoding(settings *ServerSettings, r *http.Request, resp *http.Response) {
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		addVary(resp.Header, "Accept-Encoding")
+		// Partial and bodiless responses can't be decoded
+		if acceptsEncoding(r, "gzip") || resp.StatusCode != http.StatusOK {
+			return
+		}
+		gunzipResponse(r, resp)
+	case "":
+		if !settings.CompressResponses || resp.StatusCode != http.StatusOK ||
+			!isCompressibleType(settings, resp.Header.Get("Content-Type")) ||
+			(resp.ContentLength >= 0 && resp.ContentLength < settings.CompressMinSize) {
+			return
+		}
+		addVary(resp.Header, "Accept-Encoding")
+		if !acceptsEncoding(r, "gzip") || r.Header.Get("Range") != "" {
+			return
+		}
+		gzipResponse(r, resp)
+	}
+}
+
+// Drops the Range of a request for a gzipped file that will be decompressed for the client, so
+// the whole file is fetched rather than a part that can't be decoded
+func ignoreRangeForGunzip(settings *ServerSettings, r *http.Request) {
+	if r.Header.Get("Range") == "" || acceptsEncoding(r, "gzip") {
+		return
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(r.URL.Path), "."))
+	for _, gzipped := range settings.ExtGzippeddTypes {
+		if ext == strings.ToLower(gzipped) {
+			r.Header.Del("Range")
+			r.Header.Del("If-Range")
+			return
+		}
+	}
+}
+
+// Marks a response as having a new body of unknown length
+func setTransformedBody(resp *http.Response, body io.ReadCloser) {
+	resp.Body = body
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	// Still the same file, but no longer the same bytes
+	if etag := resp.Header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// Decompresses a gzip encoded response. Files that are labelled as gzip without being compressed,
+// as some .svgz files are, are sent as they are.
+func gunzipResponse(r *http.Request, resp *http.Response) {
+	resp.Header.Del("Content-Encoding")
+	if r.Method == "HEAD" {
+		setTransformedBody(resp, resp.Body)
+		return
+	}
+	reader := bufio.NewReader(resp.Body)
+	magic, _ := reader.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		resp.Body = &readCloser{Reader: reader, Closer: resp.Body}
+		return
+	}
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		fmt.Printf("[Compression] Error decompressing %s: %s\n", r.URL, err)
+		setTransformedBody(resp, &readCloser{Reader: reader, Closer: resp.Body})
+		return
+	}
+	setTransformedBody(resp, &readCloser{Reader: gzipReader, Closer: resp.Body})
+}
+
+// Gzips a response as it's read
+func gzipResponse(r *http.Request, resp *http.Response) {
+	resp.Header.Set("Content-Encoding", "gzip")
+	if r.Method == "HEAD" {
+		setTransformedBody(resp, resp.Body)
+		return
+	}
+	body := resp.Body
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		gzipWriter := gzip.NewWriter(pipeWriter)
+		_, err := io.Copy(gzipWriter, body)
+		if err == nil {
+			err = gzipWriter.Close()
+		}
+		body.Close()
+		pipeWriter.CloseWithError(err)
+	}()
+	setTransformedBody(resp, pipeReader)
+}
+
+// Checks the compression settings, returning every problem found
+func validateCompression(settings *ServerSettings) SettingsErrors {
+	problems := SettingsErrors{}
+	if settings.CompressMinSize < 0 {
+		problems = append(problems, SettingError{Key: "compressMinSize", Message: "must not be negative"})
+	}
+	for i, pattern := range settings.CompressMimeTypes {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+			problems = append(problems, SettingError{Key: fmt.Sprintf("compressMimeTypes[%d]", i), Message: fmt.Sprintf("invalid media type pattern %q, must be like text/* or application/json", pattern)})
+		}
+	}
+	return problems
+}
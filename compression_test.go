@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Returns data gzipped
+func gzipTestData(t *testing.T, data string) string {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte(data))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// Returns a body gunzipped
+func gunzipTestData(t *testing.T, data []byte) string {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		coding         string
+		expected       bool
+	}{
+		{"", "gzip", false},
+		{"gzip, deflate, br", "br", true},
+		{"gzip;q=0", "gzip", false},
+		{"x-gzip", "gzip", true},
+		{"*", "br", true},
+		{"*, br;q=0", "br", false},
+		{"deflate", "gzip", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		if acceptsEncoding(r, test.coding) != test.expected {
+			t.Errorf("%q accepting %s: expected %v", test.acceptEncoding, test.coding, test.expected)
+		}
+	}
+}
+
+func TestCompressionLegacySidecar(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.ExtMimeTypes = map[string]string{"js": "application/javascript"}
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{})
+	writeTestLegacyFile(t, &settings, "example.com/game.js", "plain")
+	writeTestLegacyFile(t, &settings, "example.com/game.js.gz", gzipTestData(t, "gzipped"))
+	writeTestLegacyFile(t, &settings, "example.com/game.js.br", "brotli")
+
+	tests := []struct {
+		acceptEncoding string
+		coding         string
+		body           string
+	}{
+		{"gzip, br", "br", "brotli"},
+		{"gzip", "gzip", gzipTestData(t, "gzipped")},
+		{"", "", "plain"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/game.js", nil)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		_, resp := handleRequest(r, nil)
+		body := readTestResponse(t, resp)
+		if resp.Header.Get("Content-Encoding") != test.coding || string(body) != test.body {
+			t.Errorf("%q: expected %q %q, got %q %q", test.acceptEncoding, test.coding, test.body, resp.Header.Get("Content-Encoding"), body)
+		}
+		if resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%q: expected Vary: Accept-Encoding, got %q", test.acceptEncoding, resp.Header.Get("Vary"))
+		}
+		if resp.Header.Get("Content-Type") != "application/javascript" {
+			t.Errorf("%q: expected the original's content type, got %q", test.acceptEncoding, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestCompressionZipSidecar(t *testing.T) {
+	settings := testServerSettings
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/data.xml":    "<plain/>",
+		"content/example.com/data.xml.gz": gzipTestData(t, "<gzipped/>"),
+	})
+
+	r := httptest.NewRequest("GET", "http://example.com/data.xml", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	_, resp := handleRequest(r, nil)
+	body := readTestResponse(t, resp)
+	if resp.Header.Get("Content-Encoding") != "gzip" || gunzipTestData(t, body) != "<gzipped/>" {
+		t.Errorf("expected the gzip sidecar, got %q %q", resp.Header.Get("Content-Encoding"), body)
+	}
+	if resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("expected Vary: Accept-Encoding, got %q", resp.Header.Get("Vary"))
+	}
+}
+
+func TestCompressionZipSidecarLookups(t *testing.T) {
+	settings := testServerSettings
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/data.xml":    "<plain/>",
+		"content/example.com/data.xml.br": "brotli",
+		"content/example.com/data.xml.gz": gzipTestData(t, "<gzipped/>"),
+	})
+	mountedZipServer := zipServer
+	t.Cleanup(func() { zipServer = mountedZipServer })
+	lookups := []string{}
+	zipServer = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups = append(lookups, path.Ext(r.URL.Path))
+		mountedZipServer.ServeHTTP(w, r)
+	})
+
+	tests := []struct {
+		acceptEncoding string
+		coding         string
+		lookups        []string
+	}{
+		{"br, gzip", "br", []string{".br"}},
+		{"gzip", "gzip", []string{".gz"}},
+		{"", "", []string{}},
+	}
+	for _, test := range tests {
+		lookups = []string{}
+		r := httptest.NewRequest("GET", "http://localhost/content/example.com/data.xml", nil)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		plain := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("<plain/>"))}
+		resp := serveZipSidecar(r, plain)
+		readTestResponse(t, resp)
+		if resp.Header.Get("Content-Encoding") != test.coding {
+			t.Errorf("%q: expected coding %q, got %q", test.acceptEncoding, test.coding, resp.Header.Get("Content-Encoding"))
+		}
+		if strings.Join(lookups, " ") != strings.Join(test.lookups, " ") {
+			t.Errorf("%q: expected lookups %v, got %v", test.acceptEncoding, test.lookups, lookups)
+		}
+	}
+}
+
+func TestCompressionGunzip(t *testing.T) {
+	settings := testServerSettings
+	settings.ExtGzippeddTypes = []string{"svgz"}
+	settings.ExtMimeTypes = map[string]string{"svgz": "image/svg+xml"}
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/image.svgz": gzipTestData(t, "<svg/>"),
+		"content/example.com/plain.svgz": "<svg/>",
+	})
+
+	for _, name := range []string{"image.svgz", "plain.svgz"} {
+		_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/"+name, nil), nil)
+		body := readTestResponse(t, resp)
+		if resp.Header.Get("Content-Encoding") != "" || string(body) != "<svg/>" {
+			t.Errorf("%s: expected to be decompressed, got %q %q", name, resp.Header.Get("Content-Encoding"), body)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/image.svgz", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	_, resp := handleRequest(r, nil)
+	body := readTestResponse(t, resp)
+	if resp.Header.Get("Content-Encoding") != "gzip" || gunzipTestData(t, body) != "<svg/>" {
+		t.Errorf("expected gzip to be kept, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	// Part of the gzip stream can't be decompressed, so the whole file is sent instead
+	r = httptest.NewRequest("GET", "http://example.com/image.svgz", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	_, resp = handleRequest(r, nil)
+	body = readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" || string(body) != "<svg/>" {
+		t.Errorf("expected the whole file decompressed, got %d %q %q", resp.StatusCode, resp.Header.Get("Content-Encoding"), body)
+	}
+}
+
+func TestCompressionOnTheFly(t *testing.T) {
+	settings := testServerSettings
+	settings.CompressResponses = true
+	settings.CompressMinSize = 16
+	settings.CompressMimeTypes = []string{"text/*"}
+	settings.ExtMimeTypes = map[string]string{"txt": "text/plain", "swf": "application/x-shockwave-flash"}
+	setup(&settings)
+	text := strings.Repeat("compressible ", 100)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/big.txt":   text,
+		"content/example.com/small.txt": "tiny",
+		"content/example.com/game.swf":  text,
+	})
+
+	tests := []struct {
+		name       string
+		compressed bool
+		vary       bool
+	}{
+		{"big.txt", true, true},
+		{"small.txt", false, false},
+		{"game.swf", false, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/"+test.name, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		_, resp := handleRequest(r, nil)
+		body := readTestResponse(t, resp)
+		compressed := resp.Header.Get("Content-Encoding") == "gzip"
+		if compressed != test.compressed {
+			t.Errorf("%s: expected compressed to be %v", test.name, test.compressed)
+		} else if compressed && gunzipTestData(t, body) != text {
+			t.Errorf("%s: body didn't decompress to the original", test.name)
+		}
+		if (resp.Header.Get("Vary") == "Accept-Encoding") != test.vary {
+			t.Errorf("%s: expected Vary to be set %v, got %q", test.name, test.vary, resp.Header.Get("Vary"))
+		}
+	}
+
+	// Ranges are answered uncompressed
+	r := httptest.NewRequest("GET", "http://example.com/big.txt", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Range", "bytes=0-11")
+	_, resp := handleRequest(r, nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "compressible" {
+		t.Errorf("expected an uncompressed 206, got %d %q", resp.StatusCode, body)
+	}
+}
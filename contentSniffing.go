@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+/** Content sniffing
+ * The content type normally comes from the extension of the request path or the file it was served
+ * from, so URLs like /getgame?id=5 get none. When that happens the start of the body is checked
+ * for the magic numbers of the formats games use, and given the type extMimeTypes has for that
+ * format's extension.
+ * With sniffOverridesExtension on, the body is checked even when the extension has a type, to fix
+ * files saved under the wrong extension, such as an HTML error page archived as game.swf. Only
+ * reliable signatures override the extension, and markup only overrides types that aren't text,
+ * so a .js or .txt file that happens to start with a tag keeps its type.
+ */
+
+// How much of the body is checked
+const sniffLength = 512
+
+// A format recognised by its first bytes
+type contentSniffer struct {
+	// Extension used to look the type up in extMimeTypes
+	ext string
+	// Type used when extMimeTypes has none for ext
+	mime  string
+	match func(data []byte) bool
+	// Too easily matched by chance to override the extension
+	weak bool
+	// Markup, which only overrides types that aren't text
+	markup bool
+}
+
+// Returns a matcher for bodies starting with any of the prefixes
+func hasAnyPrefix(prefixes ...string) func(data []byte) bool {
+	return func(data []byte) bool {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(data, []byte(prefix)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Returns whether the body is a Director movie, RIFX is big endian and XFIR little endian
+func isDirectorMovie(data []byte) bool {
+	return hasAnyPrefix("RIFX", "XFIR")(data)
+}
+
+// Returns whether the body is a compressed Shockwave movie rather than an editable Director one
+func isShockwaveMovie(data []byte) bool {
+	return isDirectorMovie(data) && len(data) >= 12 && (string(data[8:12]) == "FGDM" || string(data[8:12]) == "MDGF")
+}
+
+// Returns whether the body is a zip whose first entry is in META-INF, as jar files are
+func isJavaArchive(data []byte) bool {
+	// The first entry's name starts 30 bytes into the local file header
+	return bytes.HasPrefix(data, []byte("PK\x03\x04")) && len(data) > 30 && bytes.HasPrefix(data[30:], []byte("META-INF/"))
+}
+
+// Returns whether the body starts with an MPEG audio frame header
+func isMpegAudioFrame(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0
+}
+
+// Returns the body with any byte order mark and leading whitespace removed, lowercased
+func markupStart(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	return bytes.ToLower(bytes.TrimLeft(data, " \t\r\n\f"))
+}
+
+// Returns whether the body starts like an XML document
+func isXmlDocument(data []byte) bool {
+	return bytes.HasPrefix(markupStart(data), []byte("<?xml"))
+}
+
+// Tags an HTML document is likely to start with, as http.DetectContentType uses
+var htmlStartTags = []string{
+	"<!doctype html", "<html", "<head", "<body", "<script", "<iframe", "<title", "<style",
+	"<table", "<div", "<font", "<h1", "<p", "<br", "<b", "<a", "<!--",
+}
+
+// Returns whether the body starts like an HTML document
+func isHtmlDocument(data []byte) bool {
+	data = markupStart(data)
+	for _, tag := range htmlStartTags {
+		if bytes.HasPrefix(data, []byte(tag)) && len(data) > len(tag) {
+			// The tag must end there, so <bold> isn't taken for <b>
+			if next := data[len(tag)]; next == ' ' || next == '>' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Every recognised format, checked in order
+var contentSniffers = []contentSniffer{
+	{ext: "swf", mime: "application/x-shockwave-flash", match: hasAnyPrefix("FWS", "CWS", "ZWS")},
+	{ext: "dcr", mime: "application/x-director", match: isShockwaveMovie},
+	{ext: "dir", mime: "application/x-director", match: isDirectorMovie},
+	{ext: "unity3d", mime: "application/vnd.unity", match: hasAnyPrefix("UnityWeb", "UnityRaw", "UnityFS")},
+	{ext: "class", mime: "application/java", match: hasAnyPrefix("\xCA\xFE\xBA\xBE")},
+	{ext: "jar", mime: "application/java-archive", match: isJavaArchive},
+	{ext: "png", mime: "image/png", match: hasAnyPrefix("\x89PNG\r\n\x1A\n")},
+	{ext: "gif", mime: "image/gif", match: hasAnyPrefix("GIF87a", "GIF89a")},
+	{ext: "jpg", mime: "image/jpeg", match: hasAnyPrefix("\xFF\xD8\xFF")},
+	{ext: "flv", mime: "video/x-flv", match: hasAnyPrefix("FLV\x01")},
+	{ext: "mp3", mime: "audio/mpeg", match: hasAnyPrefix("ID3")},
+	{ext: "mp3", mime: "audio/mpeg", match: isMpegAudioFrame, weak: true},
+	{ext: "xml", mime: "application/xml", match: isXmlDocument, markup: true},
+	{ext: "html", mime: "text/html", match: isHtmlDocument, markup: true},
+}
+
+// Returns the format the data starts with, or nil if it isn't recognised
+func sniffContent(data []byte) *contentSniffer {
+	for i := range contentSniffers {
+		if contentSniffers[i].match(data) {
+			return &contentSniffers[i]
+		}
+	}
+	return nil
+}
+
+// Returns whether a type is read as text, so markup isn't allowed to override it
+func isTextualType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") || strings.Contains(mediaType, "xml") ||
+		strings.Contains(mediaType, "javascript") || strings.Contains(mediaType, "json")
+}
+
+// Returns the type sniffed from the start of the response body, or "" if there's no better type than
+// extMime, the one given by the extension. The body is left to be read from the start.
+func sniffContentType(settings *ServerSettings, r *http.Request, resp *http.Response, extMime string) string {
+	if r.Method == "HEAD" || resp.StatusCode != http.StatusOK || resp.ContentLength == 0 || resp.Header.Get("Content-Encoding") != "" {
+		return ""
+	}
+	reader := bufio.NewReaderSize(resp.Body, sniffLength)
+	resp.Body = &readCloser{Reader: reader, Closer: resp.Body}
+	// A short body gives what there is along with an error
+	data, _ := reader.Peek(sniffLength)
+	sniffer := sniffContent(data)
+	if sniffer == nil {
+		return ""
+	}
+	sniffed := settings.ExtMimeTypes[sniffer.ext]
+	if sniffed == "" {
+		sniffed = sniffer.mime
+	}
+	if extMime == "" {
+		return sniffed
+	}
+
+	extMediaType, _, _ := mime.ParseMediaType(extMime)
+	sniffedMediaType, _, _ := mime.ParseMediaType(sniffed)
+	if sniffer.weak || extMediaType == sniffedMediaType || (sniffer.markup && isTextualType(extMediaType)) {
+		return ""
+	}
+	if settings.VerboseLogging {
+		fmt.Printf("[Sniff] %s looks like %s, not %s\n", r.URL, sniffed, extMime)
+	}
+	return sniffed
+}
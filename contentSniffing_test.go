@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSniffContent(t *testing.T) {
+	tests := []struct {
+		data string
+		ext  string
+	}{
+		{"FWS\x0a", "swf"},
+		{"CWS\x0a", "swf"},
+		{"ZWS\x0d", "swf"},
+		{"XFIR\x00\x00\x00\x00MDGFFver", "dcr"},
+		{"RIFX\x00\x00\x00\x00MV93imap", "dir"},
+		{"UnityWeb\x00", "unity3d"},
+		{"\xCA\xFE\xBA\xBE\x00\x00", "class"},
+		{"PK\x03\x04" + string(make([]byte, 26)) + "META-INF/MANIFEST.MF", "jar"},
+		{"\x89PNG\r\n\x1A\n", "png"},
+		{"GIF89a", "gif"},
+		{"\xFF\xD8\xFF\xE0", "jpg"},
+		{"FLV\x01\x05", "flv"},
+		{"ID3\x03", "mp3"},
+		{"\xFF\xFB\x90", "mp3"},
+		{"\xEF\xBB\xBF<?xml version=\"1.0\"?>", "xml"},
+		{"\n  <!DOCTYPE HTML>", "html"},
+		{"<html>", "html"},
+		{"<bold>", ""},
+		{"PK\x03\x04" + string(make([]byte, 26)) + "game/", ""},
+		{"plain text", ""},
+	}
+	for _, test := range tests {
+		ext := ""
+		if sniffer := sniffContent([]byte(test.data)); sniffer != nil {
+			ext = sniffer.ext
+		}
+		if ext != test.ext {
+			t.Errorf("%q: expected %q, got %q", test.data, test.ext, ext)
+		}
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	settings := testServerSettings
+	settings.ExtMimeTypes = map[string]string{
+		"swf": "application/x-shockwave-flash",
+		"txt": "text/plain",
+		"dcr": "application/x-director",
+	}
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/getgame":    "CWS\x0a compressed swf",
+		"content/example.com/unknown":    "nothing recognisable",
+		"content/example.com/error.swf":  "<html><body>404</body></html>",
+		"content/example.com/notes.txt":  "<b>notes</b>",
+		"content/example.com/movie.swf":  "XFIR\x00\x00\x00\x00MDGF",
+		"content/example.com/sound.swf":  "\xFF\xFB\x90",
+		"content/example.com/game.swf":   "FWS\x0a",
+		"content/example.com/short.data": "CW",
+	})
+
+	tests := []struct {
+		path        string
+		override    bool
+		contentType string
+	}{
+		{"/getgame?id=5", false, "application/x-shockwave-flash"},
+		{"/unknown", false, ""},
+		{"/short.data", false, ""},
+		{"/error.swf", false, "application/x-shockwave-flash"},
+		{"/error.swf", true, "text/html"},
+		{"/notes.txt", true, "text/plain"},
+		{"/movie.swf", true, "application/x-director"},
+		{"/sound.swf", true, "application/x-shockwave-flash"},
+		{"/game.swf", true, "application/x-shockwave-flash"},
+	}
+	for _, test := range tests {
+		settings.SniffOverridesExtension = test.override
+		storeSettings(&settings)
+		_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com"+test.path, nil), nil)
+		body := readTestResponse(t, resp)
+		if resp.Header.Get("Content-Type") != test.contentType {
+			t.Errorf("%s (override %v): expected %q, got %q", test.path, test.override, test.contentType, resp.Header.Get("Content-Type"))
+		}
+		if len(body) == 0 {
+			t.Errorf("%s: expected the whole body to be kept after sniffing", test.path)
+		}
+	}
+}
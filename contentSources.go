@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/** Content sources
+ * Each request is passed along a chain of content sources until one of them has the file.
+ * The chain is set by "contentSources" in the settings, each entry being either the name of a
+ * source or an object with its options, e.g.
+ *   "contentSources": ["zip", "legacy", {"name": "infinity", "timeout": "30s", "cache": false}]
+ * When it's empty the chain is built from the older settings: the GameZIP server, then either the
+ * internal legacy server or the external one, then the sitelock embedding pages, then Infinity and
+ * MAD4FP when they're turned on and legacy requests are handled internally.
+ */
+
+// Timeout for requests to the external legacy server, unless the content source sets its own
+const externalLegacyTimeout = 300 * time.Second
+
+// Finds the content for a request
+type ContentSource interface {
+	// Returns the source's response. A response with an error status means the source doesn't
+	// have the file and the next one is tried, an error means the source itself failed.
+	// r.Body reads the request body once, sources that make more than one request for it read
+	// body again with body.NewReader().
+	Fetch(r *http.Request, body *replayableBody, settings *ServerSettings, options ContentSourceOptions) (*http.Response, error)
+}
+
+// Every content source, keyed by the name used in the settings
+var contentSources = map[string]ContentSource{
+	"zip":      zipContentSource{},
+	"legacy":   legacyContentSource{},
+	"infinity": infinityContentSource{},
+	"mad4fp":   mad4fpContentSource{},
+	"external": externalContentSource{},
+	"sitelock": sitelockContentSource{},
+}
+
+// Options for a single source in the chain
+type ContentSourceOptions struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// How long the source has to respond, e.g. "30s". Empty uses the source's own default.
+	Timeout string `json:"timeout,omitempty"`
+	// Whether files downloaded from the internet are saved to htdocs
+	Cache bool `json:"cache"`
+}
+
+// Accepts either the name of a source or an object, enabled and cache default to true
+func (o *ContentSourceOptions) UnmarshalJSON(data []byte) error {
+	var name string
+	if json.Unmarshal(data, &name) == nil {
+		*o = ContentSourceOptions{Name: name, Enabled: true, Cache: true}
+		return nil
+	}
+	type plainOptions ContentSourceOptions
+	options := plainOptions{Enabled: true, Cache: true}
+	err := json.Unmarshal(data, &options)
+	if err != nil {
+		return err
+	}
+	*o = ContentSourceOptions(options)
+	return nil
+}
+
+// Returns the source's timeout, or def if it doesn't set one
+func (o ContentSourceOptions) timeoutOr(def time.Duration) time.Duration {
+	timeout, err := time.ParseDuration(o.Timeout)
+	if err != nil || timeout <= 0 {
+		return def
+	}
+	return timeout
+}
+
+// Returns the chain of sources to try, in order
+func contentSourceChain(settings *ServerSettings) []ContentSourceOptions {
+	if len(settings.ContentSources) > 0 {
+		return settings.ContentSources
+	}
+	names := []string{"zip"}
+	if settings.HandleLegacyRequests {
+		names = append(names, "legacy", "sitelock")
+		if settings.UseInfinityServer {
+			names = append(names, "infinity")
+		}
+		if settings.UseMad4FP {
+			names = append(names, "mad4fp")
+		}
+	} else {
+		names = append(names, "external", "sitelock")
+	}
+	chain := []ContentSourceOptions{}
+	for _, name := range names {
+		chain = append(chain, ContentSourceOptions{Name: name, Enabled: true, Cache: true})
+	}
+	return chain
+}
+
+// Returns whether a source is enabled in the chain
+func usesContentSource(settings *ServerSettings, name string) bool {
+	for _, options := range contentSourceChain(settings) {
+		if options.Name == name && options.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// Passes a request along the chain, returning the first response that has the file. If none
+// do, the most useful failure is returned, preferring a server error over a plain not found.
+func serveContent(settings *ServerSettings, r *http.Request, body *replayableBody) *http.Response {
+	var fallback *http.Response
+	for _, options := range contentSourceChain(settings) {
+		source, ok := contentSources[options.Name]
+		if !options.Enabled || !ok {
+			continue
+		}
+
+		// The timeout only covers waiting for the response to start, the body can take as long as
+		// the client takes to read it
+		ctx, cancel := context.WithCancel(r.Context())
+		var timer *time.Timer
+		timeout := options.timeoutOr(0)
+		if timeout > 0 {
+			timer = time.AfterFunc(timeout, cancel)
+		}
+		sourceRequest := r.Clone(ctx)
+		sourceRequest.Body = body.NewReader()
+		sourceRequest.ContentLength = body.size
+
+		resp, err := source.Fetch(sourceRequest, body, settings, options)
+		if timer != nil && !timer.Stop() {
+			if err == nil {
+				resp.Body.Close()
+			}
+			err = fmt.Errorf("no response within %s: %w", timeout, context.DeadlineExceeded)
+		}
+		if err != nil {
+			cancel()
+			resp = backendErrorResponse(r, options.Name, err)
+		} else {
+			// Keep the request going until the body has been read
+			resp.Body = &onCloseBody{ReadCloser: resp.Body, onClose: cancel}
+			if resp.StatusCode < 500 {
+				recordBackendSuccess(options.Name)
+			}
+		}
+
+		// A 416 means the source has the file, just not the requested range
+		if resp.StatusCode < 400 || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			if fallback != nil {
+				fallback.Body.Close()
+			}
+			return resp
+		}
+		if fallback == nil || fallback.StatusCode < 500 {
+			if fallback != nil {
+				fallback.Body.Close()
+			}
+			fallback = resp
+		} else {
+			resp.Body.Close()
+		}
+	}
+
+	if fallback == nil {
+		fmt.Printf("[Content] No content sources enabled for %s\n", r.URL)
+		fallback = serveInProcess(http.NotFoundHandler(), r)
+	}
+	if fallback.StatusCode == http.StatusNotFound {
+		fmt.Printf("[Content] 404 Not Found: %s\n", r.URL)
+	}
+	return fallback
+}
+
+// Copies a request for the legacy servers, which always see it as plain http
+func newLegacyRequest(r *http.Request) *http.Request {
+	legacyRequest := &http.Request{
+		Method: r.Method,
+		URL: &url.URL{
+			Scheme:   "http",
+			Host:     r.URL.Host,
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		},
+		Header:        r.Header,
+		Body:          r.Body,
+		ContentLength: r.ContentLength,
+	}
+	return legacyRequest.WithContext(r.Context())
+}
+
+// Copies a request for the legacy servers, with any sitelock Referer and Origin applied
+func newSitelockedRequest(settings *ServerSettings, r *http.Request) *http.Request {
+	legacyRequest := newLegacyRequest(r)
+	applySitelockHeaders(settings, legacyRequest)
+	return legacyRequest
+}
+
+// Serves files from the mounted GameZIPs
+type zipContentSource struct{}
+
+func (zipContentSource) Fetch(r *http.Request, body *replayableBody, settings *ServerSettings, options ContentSourceOptions) (*http.Response, error) {
+	var resp *http.Response
+	requestHost, port := requestHostPort(r)
+	for _, host := range candidateHosts(settings, requestHost, port) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		// Each host gets the whole body, as the last one may have read some of it
+		gamezipRequest := &http.Request{
+			Method: r.Method,
+			URL: &url.URL{
+				Path:     "/content/" + host + r.URL.Path,
+				RawQuery: r.URL.RawQuery,
+			},
+			Header:        r.Header,
+			Body:          body.NewReader(),
+			ContentLength: body.size,
+		}
+		gamezipRequest = gamezipRequest.WithContext(r.Context())
+
+		// Ask the zip server directly, streaming the response back as it's served
+		resp = serveInProcess(zipServer, gamezipRequest)
+		if resp.StatusCode < 400 {
+			resp = serveZipSidecar(gamezipRequest, resp)
+		}
+		if resp.StatusCode >= 500 {
+			fmt.Println("Gamezip Server Error: ", resp.StatusCode)
+			recordBackendFailure(backendGameZip, fmt.Errorf("status %s", resp.Status))
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			if host != requestHost && resp.StatusCode < 400 {
+				fmt.Printf("[Hosts] Served %s from %s\n", r.URL, host)
+			}
+			return resp, nil
+		}
+	}
+	return resp, nil
+}
+
+// Serves local files from htdocs and cgi-bin
+type legacyContentSource struct{}
+
+func (legacyContentSource) Fetch(r *http.Request, body *replayableBody, settings *ServerSettings, options ContentSourceOptions) (*http.Response, error) {
+	return serveInProcess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !serveLegacyLocalHosts(w, r, settings) {
+			http.NotFound(w, r)
+		}
+	}), newSitelockedRequest(settings, r)), nil
+}
+
+// Downloads files from the Infinity server
+type infinityContentSource struct{}
+
+func (infinityContentSource) Fetch(r *http.Request, body *replayableBody, settings *ServerSettings, options ContentSourceOptions) (*http.Response, error) {
+	client := newOnlineClient(options.timeoutOr(onlineRequestTimeout))
+	return serveInProcess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !serveLegacyInfinity(w, r, settings, newLegacyPaths(settings, r, r.URL.Host), client, options.Cache) {
+			http.NotFound(w, r)
+		}
+	}), newLegacyRequest(r)), nil
+}
+
+// Downloads files from the real website (MAD4FP)
+type mad4fpContentSource struct{}
+
+func (mad4fpContentSource) Fetch(r *http.Request, body *replayableBody, settings *ServerSettings, options ContentSourceOptions) (*http.Response, error) {
+	client := newOnlineClient(options.timeoutOr(onlineRequestTimeout))
+	return serveInProcess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !serveLegacyMad4fp(w, r, settings, newLegacyPaths(settings, r, r.URL.Host), client, options.Cache) {
+			http.NotFound(w, r)
+		}
+	}), newSitelockedRequest(settings, r)), nil
+}
+
+// Forwards requests to a legacy server running outside the proxy, such as Apache
+type externalContentSource struct{}
+
+func (externalContentSource) Fetch(r *http.Request, body *replayableBody, settings *ServerSettings, options ContentSourceOptions) (*http.Response, error) {
+	// Set the Proxy URL and apply it to the Transpor layer so that the request respects the proxy.
+	proxyURL, _ := url.Parse("http://127.0.0.1:" + settings.ExternalLegacyPort)
+	proxy := http.ProxyURL(proxyURL)
+	transport := &http.Transport{Proxy: proxy, ResponseHeaderTimeout: options.timeoutOr(externalLegacyTimeout)}
+
+	// A custom Dialer is required for the "localflash" urls, instead of using the DNS, we use this.
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		//Set Dialer timeout and keepalive to 30 seconds and force the address to localhost.
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		addr = "127.0.0.1:" + settings.ExternalLegacyPort
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	// Make the request with the custom transport
+	client := &http.Client{Transport: transport}
+	resp, err := client.Do(newSitelockedRequest(settings, r))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("\tServing from External Legacy...\n")
+	return resp, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Mounts a zip and writes a legacy file that both hold example.com/game.swf
+func setupTestContentSources(t *testing.T, contentSources []ContentSourceOptions) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.ContentSources = contentSources
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/game.swf": "zipped swf",
+	})
+	testFile := filepath.Join(settings.LegacyHTDOCSPath, "example.com", "game.swf")
+	err := os.MkdirAll(filepath.Dir(testFile), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(testFile, []byte("legacy swf"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContentSourcesOrder(t *testing.T) {
+	setupTestContentSources(t, []ContentSourceOptions{
+		{Name: "legacy", Enabled: true},
+		{Name: "zip", Enabled: true},
+	})
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/game.swf", nil), nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "legacy swf" {
+		t.Errorf("expected legacy file, got %s", body)
+	}
+}
+
+func TestContentSourcesDisabled(t *testing.T) {
+	setupTestContentSources(t, []ContentSourceOptions{
+		{Name: "zip", Enabled: false},
+		{Name: "legacy", Enabled: false},
+	})
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/game.swf", nil), nil)
+	readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status code 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestContentSourceChainDefault(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.UseMad4FP = true
+	names := []string{}
+	for _, options := range contentSourceChain(&settings) {
+		names = append(names, options.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"zip", "legacy", "sitelock", "mad4fp"}) {
+		t.Errorf("expected zip, legacy, sitelock, mad4fp, got %v", names)
+	}
+}
+
+func TestContentSourceOptionsUnmarshal(t *testing.T) {
+	options := []ContentSourceOptions{}
+	err := json.Unmarshal([]byte(`["zip", {"name": "infinity", "timeout": "30s", "cache": false}]`), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options[0] != (ContentSourceOptions{Name: "zip", Enabled: true, Cache: true}) {
+		t.Errorf("expected zip to be enabled and cached, got %+v", options[0])
+	}
+	if options[1] != (ContentSourceOptions{Name: "infinity", Enabled: true, Timeout: "30s", Cache: false}) {
+		t.Errorf("expected infinity options to be kept, got %+v", options[1])
+	}
+}
+
+func TestContentSourceTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/example.com/unresponsive.swf" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.InfinityServerURL = server.URL
+	settings.ContentSources = []ContentSourceOptions{{Name: "infinity", Enabled: true, Timeout: "250ms"}}
+	setup(&settings)
+
+	// Only waiting for the response to start is timed, not reading all of it
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/slow.swf", nil), nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK || string(body) != "chunkchunkchunkchunk" {
+		t.Errorf("expected the whole slow download, got %d %q", resp.StatusCode, body)
+	}
+
+	_, resp = handleRequest(httptest.NewRequest("GET", "http://example.com/unresponsive.swf", nil), nil)
+	readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusGatewayTimeout && resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an unresponsive server to time out, got %d", resp.StatusCode)
+	}
+}
+
+func TestZipContentSourceReplaysBodyForEachHost(t *testing.T) {
+	settings := testServerSettings
+	setup(&settings)
+	previousZipServer := zipServer
+	t.Cleanup(func() { zipServer = previousZipServer })
+	// Reads the body before deciding it doesn't have the file, as a script would
+	zipServer = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/content/www.example.com/save.php" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	})
+
+	body, err := newReplayableBody(strings.NewReader("score=100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "http://example.com/save.php", body.NewReader())
+	resp, err := zipContentSource{}.Fetch(r, body, &settings, ContentSourceOptions{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK || string(data) != "score=100" {
+		t.Errorf("expected the www host to get the whole body, got %d %q", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+/** CORS
+ * When allowCrossDomain is on, every response allows cross-origin requests from any origin with
+ * Access-Control-Allow-Origin: *, which browsers only honour for requests without credentials.
+ * "corsAllowedOrigins" limits the origins allowed for a host (exact, or *. for any subdomain),
+ * each entry being an origin, a host pattern or * for anything, e.g.
+ *   "corsAllowedOrigins": {"api.example.com": ["http://www.example.com", "*.kongregate.com"]}
+ * Origins named in a host's list have it echoed back along with Access-Control-Allow-Credentials,
+ * so only those sites can make credentialed requests. A * entry allows anything without them.
+ * Hosts without a list allow credentials from local pages, such as those the launcher serves, and
+ * from the host itself with or without www., e.g. www.example.com for example.com. Any other
+ * origin, even a sibling such as www.example.com for api.example.com, must be named in the host's
+ * list to send credentials.
+ * OPTIONS preflights are answered directly, they'd only 404 or run a script otherwise.
+ */
+
+// Methods allowed when the preflight doesn't ask for one
+const corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE, HEAD, OPTIONS"
+
+// How long browsers may cache a preflight, in seconds
+const corsMaxAge = "86400"
+
+// Returns whether a request is a CORS preflight
+func isCorsPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Answers a CORS preflight, the allow headers are added along with every other response's
+func serveCorsPreflight(r *http.Request) *http.Response {
+	return serveInProcess(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), r)
+}
+
+// Returns whether requests from an origin are allowed for a host, and whether the origin is named
+// in the host's list so it may send credentials too
+func isCorsOriginAllowed(settings *ServerSettings, host string, origin string) (allowed bool, credentials bool) {
+	if !settings.AllowCrossDomain {
+		return false, false
+	}
+	patterns := []string{}
+	for pattern := range settings.CorsAllowedOrigins {
+		patterns = append(patterns, pattern)
+	}
+	host = strings.ToLower(host)
+	originHost := ""
+	if u, err := url.Parse(origin); err == nil {
+		originHost = strings.ToLower(u.Hostname())
+	}
+	pattern := bestHostPattern(host, patterns)
+	if pattern == "" {
+		return true, originHost != "" && (isLocalHost(originHost) || isSameSite(host, originHost))
+	}
+	wildcard := false
+	for _, allowed := range settings.CorsAllowedOrigins[pattern] {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" {
+			wildcard = true
+		} else if allowed == strings.ToLower(origin) || (!strings.Contains(allowed, "://") && hostMatchesPattern(originHost, allowed)) {
+			return true, origin != ""
+		}
+	}
+	return wildcard, false
+}
+
+// Returns whether two hosts are the same site, which is only the host itself with or without
+// www. Parent domains aren't shared, as without the public suffix list there's no telling
+// example.co.uk, a site, from co.uk, which isn't.
+func isSameSite(host string, otherHost string) bool {
+	return strings.TrimPrefix(host, "www.") == strings.TrimPrefix(otherHost, "www.")
+}
+
+// Adds the CORS headers to a response, if the request's origin is allowed
+func applyCorsHeaders(settings *ServerSettings, r *http.Request, resp *http.Response) {
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		// The answer depends on the origin, don't let caches share it
+		addVary(resp.Header, "Origin")
+	}
+	allowed, credentials := isCorsOriginAllowed(settings, r.URL.Host, origin)
+	if !allowed {
+		if origin != "" && settings.VerboseLogging {
+			fmt.Printf("[CORS] Origin %s not allowed for %s\n", origin, r.URL)
+		}
+		return
+	}
+
+	if origin == "" {
+		resp.Header.Set("Access-Control-Allow-Origin", "*")
+		resp.Header.Set("Access-Control-Allow-Methods", "*")
+		resp.Header.Set("Access-Control-Allow-Headers", "*")
+		return
+	}
+	if credentials {
+		// * is taken literally for credentialed requests, so the origin is echoed back instead
+		resp.Header.Set("Access-Control-Allow-Origin", origin)
+		resp.Header.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		resp.Header.Set("Access-Control-Allow-Origin", "*")
+	}
+	resp.Header.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+	if method := r.Header.Get("Access-Control-Request-Method"); method != "" && !strings.Contains(corsAllowedMethods, strings.ToUpper(method)) {
+		resp.Header.Set("Access-Control-Allow-Methods", corsAllowedMethods+", "+strings.ToUpper(method))
+	}
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		resp.Header.Set("Access-Control-Allow-Headers", headers)
+	}
+	if isCorsPreflight(r) {
+		resp.Header.Set("Access-Control-Max-Age", corsMaxAge)
+	}
+}
+
+// Checks the per-host origin lists, returning every problem found
+func validateCorsAllowedOrigins(settings *ServerSettings) SettingsErrors {
+	problems := SettingsErrors{}
+	patterns := []string{}
+	for pattern := range settings.CorsAllowedOrigins {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		key := "corsAllowedOrigins." + pattern
+		if problem := validateHostPattern(pattern); problem != "" {
+			problems = append(problems, SettingError{Key: key, Message: problem})
+		}
+		for i, allowed := range settings.CorsAllowedOrigins[pattern] {
+			if allowed == "*" {
+				continue
+			}
+			var problem string
+			if strings.Contains(allowed, "://") {
+				if err := validateServerURL(allowed); err != nil {
+					problem = err.Error()
+				}
+			} else {
+				problem = validateHostPattern(allowed)
+			}
+			if problem != "" {
+				problems = append(problems, SettingError{Key: fmt.Sprintf("%s[%d]", key, i), Message: problem})
+			}
+		}
+	}
+	return problems
+}
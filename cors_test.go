@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func setupTestCors(t *testing.T, allowCrossDomain bool, allowedOrigins map[string][]string) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.AllowCrossDomain = allowCrossDomain
+	settings.CorsAllowedOrigins = allowedOrigins
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/data.json": "{}",
+	})
+}
+
+func TestCorsPreflight(t *testing.T) {
+	setupTestCors(t, true, nil)
+
+	r := httptest.NewRequest("OPTIONS", "http://example.com/save.php", nil)
+	r.Header.Set("Origin", "http://game.example.org")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "content-type, x-requested-with")
+	_, resp := handleRequest(r, nil)
+	readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code 204, got %d", resp.StatusCode)
+	}
+	// No list for the host, so any origin is allowed but not with credentials
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "*",
+		"Access-Control-Allow-Credentials": "",
+		"Access-Control-Allow-Headers":     "content-type, x-requested-with",
+		"Access-Control-Max-Age":           corsMaxAge,
+	}
+	for name, value := range expected {
+		if resp.Header.Get(name) != value {
+			t.Errorf("expected %s: %s, got %q", name, value, resp.Header.Get(name))
+		}
+	}
+}
+
+func TestCorsWithoutOrigin(t *testing.T) {
+	setupTestCors(t, true, nil)
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/data.json", nil), nil)
+	readTestResponse(t, resp)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected any origin to be allowed, got %q", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("expected no credentials header with *")
+	}
+}
+
+func TestCorsDisabled(t *testing.T) {
+	setupTestCors(t, false, nil)
+
+	r := httptest.NewRequest("GET", "http://example.com/data.json", nil)
+	r.Header.Set("Origin", "http://game.example.org")
+	_, resp := handleRequest(r, nil)
+	readTestResponse(t, resp)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no CORS headers, got %q", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCorsAllowedOrigins(t *testing.T) {
+	setupTestCors(t, true, map[string][]string{
+		"example.com": {"http://www.kongregate.com", "*.newgrounds.com"},
+	})
+
+	for origin, allowed := range map[string]bool{
+		"http://www.kongregate.com":     true,
+		"http://uploads.newgrounds.com": true,
+		"http://game.example.org":       false,
+	} {
+		r := httptest.NewRequest("GET", "http://example.com/data.json", nil)
+		r.Header.Set("Origin", origin)
+		_, resp := handleRequest(r, nil)
+		readTestResponse(t, resp)
+		if got := resp.Header.Get("Access-Control-Allow-Origin") == origin; got != allowed {
+			t.Errorf("%s: expected allowed %t, got %t", origin, allowed, got)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Credentials") == "true"; got != allowed {
+			t.Errorf("%s: expected credentials %t, got %t", origin, allowed, got)
+		}
+	}
+}
+
+func TestCorsWildcardEntry(t *testing.T) {
+	setupTestCors(t, true, map[string][]string{
+		"example.com": {"http://www.kongregate.com", "*"},
+	})
+
+	r := httptest.NewRequest("GET", "http://example.com/data.json", nil)
+	r.Header.Set("Origin", "http://game.example.org")
+	_, resp := handleRequest(r, nil)
+	readTestResponse(t, resp)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" || resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("expected * without credentials, got %q %q", resp.Header.Get("Access-Control-Allow-Origin"), resp.Header.Get("Access-Control-Allow-Credentials"))
+	}
+}
+
+func TestCorsDefaultCredentials(t *testing.T) {
+	setupTestCors(t, true, nil)
+
+	for origin, credentials := range map[string]bool{
+		"http://www.example.com":  true,
+		"http://example.com":      true,
+		"http://localhost:22500":  true,
+		"http://game.example.org": false,
+	} {
+		r := httptest.NewRequest("GET", "http://example.com/data.json", nil)
+		r.Header.Set("Origin", origin)
+		_, resp := handleRequest(r, nil)
+		readTestResponse(t, resp)
+		expectedOrigin := "*"
+		if credentials {
+			expectedOrigin = origin
+		}
+		if resp.Header.Get("Access-Control-Allow-Origin") != expectedOrigin || (resp.Header.Get("Access-Control-Allow-Credentials") == "true") != credentials {
+			t.Errorf("%s: expected %s with credentials %t, got %q %q", origin, expectedOrigin, credentials, resp.Header.Get("Access-Control-Allow-Origin"), resp.Header.Get("Access-Control-Allow-Credentials"))
+		}
+		if vary := resp.Header.Values("Vary"); len(vary) != 1 || vary[0] != "Origin" {
+			t.Errorf("%s: expected Vary: Origin once, got %q", origin, vary)
+		}
+	}
+}
+
+func TestIsSameSite(t *testing.T) {
+	tests := []struct {
+		host      string
+		otherHost string
+		expected  bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", true},
+		{"www.example.com", "example.com", true},
+		{"api.example.com", "www.example.com", false},
+		{"api.example.com", "example.com", false},
+		{"cdn.game.example.com", "www.example.com", false},
+		{"a.co.uk", "b.co.uk", false},
+		{"example.co.uk", "co.uk", false},
+		{"example.com", "example.org", false},
+		{"example.com", "badexample.com", false},
+	}
+	for _, test := range tests {
+		if isSameSite(test.host, test.otherHost) != test.expected {
+			t.Errorf("%s and %s: expected same site %t", test.host, test.otherHost, test.expected)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+/** Host aliases
+ * Games often request a host that their content isn't stored under, such as www.example.com or
+ * cdn3.example.com for content in example.com/. Local lookups (GameZIP content/ and the legacy
+ * htdocs) try each candidate host in turn:
+ * 1. The requested host with its port, e.g. example.com_8080, for games that served different
+ *    content per port. The default ports 80 and 443 are skipped.
+ * 2. The requested host
+ * 3. The host it's aliased to by "hostAliases", e.g. {"*.cdn.example.com": "example.com"}
+ * 4. The host with www. added or removed
+ * 5. Wildcard directories for each parent domain, e.g. *.example.com. As * isn't allowed in
+ *    file names on Windows, _.example.com is also checked.
+ * IP addresses only get the first three. IPv6 addresses are stored without their brackets and with
+ * dashes for colons, which Windows doesn't allow in file names, e.g. [::1]:8080 under --1_8080.
+ */
+
+// Key of the port handleRequest strips from the URL, kept in the request's context
+type requestPortKey struct{}
+
+// Splits a URL host into its host and port, keeping the brackets of an IPv6 host so it's still
+// valid in a URL
+func splitHostPort(hostport string) (string, string) {
+	u := &url.URL{Host: hostport}
+	host := u.Hostname()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return host, u.Port()
+}
+
+// Removes the port from a request's URL, keeping it in the request's context for lookups
+func stripRequestPort(r *http.Request) *http.Request {
+	host, port := splitHostPort(r.URL.Host)
+	r.URL.Host = host
+	return r.WithContext(context.WithValue(r.Context(), requestPortKey{}, port))
+}
+
+// Returns the host and port of a request, whether or not the port has been stripped from its URL
+func requestHostPort(r *http.Request) (string, string) {
+	host, port := splitHostPort(r.URL.Host)
+	if strippedPort, ok := r.Context().Value(requestPortKey{}).(string); ok && port == "" {
+		port = strippedPort
+	}
+	return host, port
+}
+
+// Returns the directory name a host's content is stored under
+func hostDirectory(host string) string {
+	return strings.ReplaceAll(strings.Trim(host, "[]"), ":", "-")
+}
+
+// Returns whether a host is an IP address rather than a domain
+func isIPHost(host string) bool {
+	return net.ParseIP(strings.Trim(host, "[]")) != nil
+}
+
+// Returns the hosts to look for content under, in the order they should be tried
+func candidateHosts(settings *ServerSettings, host string, port string) []string {
+	hosts := []string{}
+	seen := map[string]bool{}
+	add := func(candidate string) {
+		if candidate != "" && !seen[candidate] {
+			seen[candidate] = true
+			hosts = append(hosts, candidate)
+		}
+	}
+
+	if port != "" && port != "80" && port != "443" {
+		add(hostDirectory(host) + "_" + port)
+		add(hostDirectory(strings.ToLower(host)) + "_" + port)
+	}
+	add(hostDirectory(host))
+	host = strings.ToLower(host)
+	add(hostDirectory(host))
+	add(hostAlias(settings, host))
+	// An address has no www. or parent domains
+	if isIPHost(host) {
+		return hosts
+	}
+	if strings.HasPrefix(host, "www.") {
+		add(strings.TrimPrefix(host, "www."))
+	} else {
+		add("www." + host)
+	}
+	// Stop before the top level domain, *.com would match far too much
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		parent := strings.Join(labels[i:], ".")
+		add("*." + parent)
+		add("_." + parent)
+	}
+	return hosts
+}
+
+// Returns the host a host is aliased to, or "" if it isn't. Exact rules win over wildcards,
+// and longer wildcards win over shorter ones.
+func hostAlias(settings *ServerSettings, host string) string {
+	patterns := []string{}
+	for pattern := range settings.HostAliases {
+		patterns = append(patterns, pattern)
+	}
+	pattern := bestHostPattern(host, patterns)
+	if pattern == "" {
+		return ""
+	}
+	return strings.ToLower(settings.HostAliases[pattern])
+}
+
+// Lowercases the patterns of a layer's host aliases, as hosts are lowered before they're looked
+// up. Of patterns that only differ by case, the first in sorted order is kept.
+func lowerHostAliases(value json.RawMessage) (json.RawMessage, error) {
+	aliases := map[string]string{}
+	err := json.Unmarshal(value, &aliases)
+	if err != nil {
+		return nil, err
+	}
+	patterns := []string{}
+	for pattern := range aliases {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	lowerAliases := map[string]string{}
+	for _, pattern := range patterns {
+		lowerPattern := strings.ToLower(pattern)
+		if _, ok := lowerAliases[lowerPattern]; !ok {
+			lowerAliases[lowerPattern] = aliases[pattern]
+		}
+	}
+	return json.Marshal(lowerAliases)
+}
+
+// Returns the pattern that best matches a host, or "" if none do. The host itself wins over
+// wildcards, and longer wildcards win over shorter ones.
+func bestHostPattern(host string, patterns []string) string {
+	bestPattern := ""
+	for _, pattern := range patterns {
+		if pattern == host {
+			return pattern
+		}
+		if hostMatchesPattern(host, pattern) && len(pattern) > len(bestPattern) {
+			bestPattern = pattern
+		}
+	}
+	return bestPattern
+}
+
+// Returns whether a host matches a pattern, either the host itself or *. followed by a domain to
+// match any of its subdomains
+func hostMatchesPattern(host string, pattern string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// Checks a host pattern, returning a description of the problem or "" if it's valid
+func validateHostPattern(pattern string) string {
+	if pattern == "" || strings.Contains(strings.TrimPrefix(pattern, "*."), "*") || strings.ContainsAny(pattern, "/:") {
+		return fmt.Sprintf("invalid host pattern %q, must be a host or *. followed by a domain", pattern)
+	}
+	return ""
+}
+
+// Checks an alias rule, returning a description of the problem or "" if it's valid
+func validateHostAlias(pattern string, target string) string {
+	if problem := validateHostPattern(pattern); problem != "" {
+		return problem
+	}
+	if target == "" || strings.ContainsAny(target, "*/:") {
+		return fmt.Sprintf("invalid alias %q for %s, must be a host", target, pattern)
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCandidateHosts(t *testing.T) {
+	settings := &ServerSettings{HostAliases: map[string]string{
+		"*.example.com":     "wrong.com",
+		"*.cdn.example.com": "example.com",
+	}}
+	hosts := candidateHosts(settings, "CDN3.cdn.example.com", "")
+	expected := []string{
+		"CDN3.cdn.example.com",
+		"cdn3.cdn.example.com",
+		"example.com",
+		"www.cdn3.cdn.example.com",
+		"*.cdn.example.com",
+		"_.cdn.example.com",
+		"*.example.com",
+		"_.example.com",
+	}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %v, got %v", expected, hosts)
+	}
+
+	hosts = candidateHosts(settings, "www.example.com", "80")
+	if len(hosts) < 2 || hosts[1] != "wrong.com" || hosts[2] != "example.com" {
+		t.Errorf("expected alias then www fallback, got %v", hosts)
+	}
+
+	hosts = candidateHosts(settings, "127.0.0.1", "8080")
+	expected = []string{"127.0.0.1_8080", "127.0.0.1"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %v, got %v", expected, hosts)
+	}
+
+	hosts = candidateHosts(settings, "[::1]", "8080")
+	expected = []string{"--1_8080", "--1"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %v, got %v", expected, hosts)
+	}
+}
+
+func TestHandleRequestZipWwwFallback(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/game.swf": "zipped swf",
+	})
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://www.example.com/game.swf", nil), nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "zipped swf" {
+		t.Errorf("expected zipped file, got %s", body)
+	}
+}
+
+func TestServeLegacyWildcardHost(t *testing.T) {
+	setup(&testServerSettings)
+	testFile := filepath.Join(testServerSettings.LegacyHTDOCSPath, "_.example.com", "game.swf")
+	err := os.MkdirAll(filepath.Dir(testFile), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(testFile, []byte("wildcard swf"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := &legacyServerTest{
+		request: makeNewRequest("GET", "http://cdn3.example.com/game.swf", nil),
+		response: &legacyServerTestResponse{
+			statusCode: http.StatusOK,
+			body:       []byte("wildcard swf"),
+		},
+	}
+	err = test.run()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	for hostport, expected := range map[string][2]string{
+		"example.com":      {"example.com", ""},
+		"EXAMPLE.com:8080": {"EXAMPLE.com", "8080"},
+		"[::1]:8080":       {"[::1]", "8080"},
+		"[::1]":            {"[::1]", ""},
+		"127.0.0.1:22500":  {"127.0.0.1", "22500"},
+	} {
+		host, port := splitHostPort(hostport)
+		if host != expected[0] || port != expected[1] {
+			t.Errorf("%s: expected %s and %s, got %s and %s", hostport, expected[0], expected[1], host, port)
+		}
+	}
+}
+
+func TestHandleRequestZipPort(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/lobby.swf":      "default lobby",
+		"content/example.com_8080/lobby.swf": "port 8080 lobby",
+	})
+
+	for rawURL, expected := range map[string]string{
+		"http://example.com:8080/lobby.swf": "port 8080 lobby",
+		"http://example.com:8081/lobby.swf": "default lobby",
+		"http://example.com/lobby.swf":      "default lobby",
+	} {
+		_, resp := handleRequest(httptest.NewRequest("GET", rawURL, nil), nil)
+		body := readTestResponse(t, resp)
+		if string(body) != expected {
+			t.Errorf("%s: expected %s, got %s", rawURL, expected, body)
+		}
+	}
+}
+
+func TestServeLegacyPort(t *testing.T) {
+	setup(&testServerSettings)
+	testFile := filepath.Join(testServerSettings.LegacyHTDOCSPath, "example.com_8080", "lobby.swf")
+	err := os.MkdirAll(filepath.Dir(testFile), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(testFile, []byte("port 8080 lobby"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := &legacyServerTest{
+		request: makeNewRequest("GET", "http://example.com:8080/lobby.swf", nil),
+		response: &legacyServerTestResponse{
+			statusCode: http.StatusOK,
+			body:       []byte("port 8080 lobby"),
+		},
+	}
+	err = test.run()
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -11,45 +12,97 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/FlashpointProject/zipfs"
 )
 
-// Tries to serve a legacy file if available
-func ServeLegacy(w http.ResponseWriter, r *http.Request) {
+// Timeout for requests to online servers, unless the content source sets its own
+const onlineRequestTimeout = 10 * time.Second
 
-	relPath := filepath.ToSlash(path.Join(r.URL.Host, r.URL.Path))
-	// @TODO PERFORM REQUEST MODIFICATION HERE
-	// parseHtaccessPath(serverSettings.LegacyHTDOCSPath, filepath.Dir(relPath), w, r)
-
-	relPathWithQuery := filepath.ToSlash(path.Join(r.URL.Host, r.URL.Path+url.PathEscape("?"+r.URL.RawQuery)))
-	hasQuery := r.URL.RawQuery != ""
+// Transports for online servers by timeout, shared so connections are reused
+var onlineTransports sync.Map
 
-	// Returns the data from the matching method, finishing the response
-	successCloser := func(reader io.ReadCloser, fileName string, lastModified string) {
-		w.Header().Set("Last-Modified", lastModified)
-		w.Header().Set("ZIPSVR_FILENAME", fileName)
-		size, err := io.Copy(w, reader)
-		if err != nil {
-			fmt.Printf("Error copying file to response: %s\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		} else {
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
-			w.WriteHeader(http.StatusOK)
+// Returns a client for online servers that gives up when a server takes longer than timeout to
+// connect, start responding or send the next part of the body. The body as a whole isn't timed, as
+// it's streamed at the speed the client reads it, so large files on slow connections still finish.
+func newOnlineClient(timeout time.Duration) *http.Client {
+	transport, ok := onlineTransports.Load(timeout)
+	if !ok {
+		newTransport := http.DefaultTransport.(*http.Transport).Clone()
+		dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+		newTransport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &idleTimeoutConn{Conn: conn, timeout: timeout}, nil
 		}
+		newTransport.TLSHandshakeTimeout = timeout
+		newTransport.ResponseHeaderTimeout = timeout
+		transport, _ = onlineTransports.LoadOrStore(timeout, newTransport)
 	}
+	return &http.Client{Transport: transport.(*http.Transport)}
+}
+
+// A connection whose reads time out when nothing arrives for a while
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+// Returns a context for a live request that's cancelled along with the client's request until
+// detach is called. After that only cancel ends it, so a file being cached still finishes
+// downloading when the client goes away. cancel must be called once the response is done with.
+func liveRequestContext(parent context.Context) (ctx context.Context, detach func(), cancel context.CancelFunc) {
+	ctx, cancel = context.WithCancel(detachedContext{parent})
+	detached := make(chan struct{})
+	var once sync.Once
+	go func() {
+		select {
+		case <-parent.Done():
+			cancel()
+		case <-detached:
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { once.Do(func() { close(detached) }) }, cancel
+}
+
+// Keeps the values of a context but never cancels
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// Where a legacy request may be found
+type legacyPaths struct {
+	// Where MAD4FP saves the file
+	exactContentPath       string
+	exactFilePaths         []string
+	exactOverrideFilePaths []string
+	indexFilePaths         []string
+	indexOverrideFilePaths []string
+}
 
-	/** Overview
-	 * Create groups of paths:
-	 * 1. Exact Files
-	 * 2. Directory Index Files
-	 *
-	 * Peform each check in order, checking each group in order within, to find a match:
-	 * 1. Local File
-	 * 2. Online Server
-	 * 3. Special Behaviour (MAD4FP)
-	 */
+// Builds the groups of paths a legacy request may be found at, looking under the given host
+func newLegacyPaths(settings *ServerSettings, r *http.Request, host string) *legacyPaths {
+	host = hostDirectory(host)
+	relPath := filepath.ToSlash(path.Join(host, r.URL.Path))
+	// @TODO PERFORM REQUEST MODIFICATION HERE
+	// parseHtaccessPath(settings.LegacyHTDOCSPath, filepath.Dir(relPath), w, r)
+
+	relPathWithQuery := filepath.ToSlash(path.Join(host, r.URL.Path+url.PathEscape("?"+r.URL.RawQuery)))
+	hasQuery := r.URL.RawQuery != ""
 
 	// Building groups of paths
 
@@ -57,180 +110,272 @@ func ServeLegacy(w http.ResponseWriter, r *http.Request) {
 	// Online = All non-override paths
 	// Special = Exact content path only (with index consideration)
 
-	// Override paths
-
-	exactContentPath := path.Join(serverSettings.LegacyHTDOCSPath, "content", relPath)
-	exactFilePaths := []string{}
-	exactOverrideFilePaths := []string{}
-	indexFilePaths := []string{}
-	indexOverrideFilePaths := []string{}
+	paths := &legacyPaths{
+		exactContentPath: path.Join(settings.LegacyHTDOCSPath, "content", relPath),
+	}
 
 	// 1. Exact Files
 	if hasQuery {
-		for _, override := range serverSettings.LegacyOverridePaths {
-			exactOverrideFilePaths = append(exactOverrideFilePaths, path.Join(serverSettings.LegacyHTDOCSPath, override, relPathWithQuery))
+		for _, override := range settings.LegacyOverridePaths {
+			paths.exactOverrideFilePaths = append(paths.exactOverrideFilePaths, path.Join(settings.LegacyHTDOCSPath, override, relPathWithQuery))
 		}
-		exactFilePaths = append(exactFilePaths, path.Join(serverSettings.LegacyHTDOCSPath, relPathWithQuery))
+		paths.exactFilePaths = append(paths.exactFilePaths, path.Join(settings.LegacyHTDOCSPath, relPathWithQuery))
 	}
-	for _, override := range serverSettings.LegacyOverridePaths {
-		exactOverrideFilePaths = append(exactOverrideFilePaths, path.Join(serverSettings.LegacyHTDOCSPath, override, relPath))
+	for _, override := range settings.LegacyOverridePaths {
+		paths.exactOverrideFilePaths = append(paths.exactOverrideFilePaths, path.Join(settings.LegacyHTDOCSPath, override, relPath))
 	}
-	exactFilePaths = append(exactFilePaths, path.Join(serverSettings.LegacyHTDOCSPath, relPath))
+	paths.exactFilePaths = append(paths.exactFilePaths, path.Join(settings.LegacyHTDOCSPath, relPath))
 
 	// CGI bin for scripts
-	if isScriptUrl(r.URL) {
+	if isScriptUrl(settings, r.URL) {
 		if hasQuery {
-			exactFilePaths = append(exactFilePaths, path.Join(serverSettings.LegacyCGIBINPath, relPathWithQuery))
+			paths.exactFilePaths = append(paths.exactFilePaths, path.Join(settings.LegacyCGIBINPath, relPathWithQuery))
 		}
-		exactFilePaths = append(exactFilePaths, path.Join(serverSettings.LegacyCGIBINPath, relPath))
+		paths.exactFilePaths = append(paths.exactFilePaths, path.Join(settings.LegacyCGIBINPath, relPath))
 	}
 
 	// 2. Directory Index Files
-	for _, ext := range serverSettings.ExtIndexTypes {
-		for _, override := range serverSettings.LegacyOverridePaths {
-			indexOverrideFilePaths = append(indexOverrideFilePaths, path.Join(serverSettings.LegacyHTDOCSPath, override, relPath, "index."+ext))
+	for _, ext := range settings.ExtIndexTypes {
+		for _, override := range settings.LegacyOverridePaths {
+			paths.indexOverrideFilePaths = append(paths.indexOverrideFilePaths, path.Join(settings.LegacyHTDOCSPath, override, relPath, "index."+ext))
 		}
-		indexFilePaths = append(indexFilePaths, path.Join(serverSettings.LegacyHTDOCSPath, relPath, "index."+ext))
+		paths.indexFilePaths = append(paths.indexFilePaths, path.Join(settings.LegacyHTDOCSPath, relPath, "index."+ext))
 	}
 
-	// Try and find a valid file to respond with
+	return paths
+}
 
-	// 1. Local File
-	for _, filePath := range append(append(append(exactFilePaths, exactOverrideFilePaths...), indexFilePaths...), indexOverrideFilePaths...) {
+// Serves a local file under any of the candidate hosts for the request.
+// Returns false without writing anything if there's no such file.
+func serveLegacyLocalHosts(w http.ResponseWriter, r *http.Request, settings *ServerSettings) bool {
+	requestHost, port := requestHostPort(r)
+	for _, host := range candidateHosts(settings, requestHost, port) {
+		if serveLegacyLocal(w, r, settings, newLegacyPaths(settings, r, host)) {
+			if host != requestHost {
+				fmt.Printf("[Hosts] Served %s from %s\n", r.URL, host)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Serves a file from htdocs, the override paths or cgi-bin, running scripts through PHP.
+// Returns false without writing anything if there's no such file.
+func serveLegacyLocal(w http.ResponseWriter, r *http.Request, settings *ServerSettings, paths *legacyPaths) bool {
+	for _, filePath := range append(append(append(paths.exactFilePaths, paths.exactOverrideFilePaths...), paths.indexFilePaths...), paths.indexOverrideFilePaths...) {
 		// Check if file exists
 		stats, err := os.Stat(filePath)
 		if err == nil && !stats.IsDir() {
 			// If it's a PHP file, let CGI handle instead
-			for _, ext := range serverSettings.ExtScriptTypes {
-				if filepath.Ext(filePath) == "."+ext {
-					fmt.Printf("[Legacy] Executing script file: %s\n", filepath.ToSlash(filePath))
-					zipfs.Cgi(w, r, serverSettings.PhpCgiPath, filePath)
-					return
+			if isScriptFile(settings, filePath) {
+				fmt.Printf("[Legacy] Executing script file: %s\n", filepath.ToSlash(filePath))
+				zipfs.Cgi(w, r, settings.PhpCgiPath, filePath)
+				return true
+			}
+			// File exists and is static, serve a pre-compressed copy instead if the client accepts one
+			servePath, serveStats := filePath, stats
+			if found, sidecarPath, sidecarStats, coding := findSidecarFile(r, filePath); found {
+				addVary(w.Header(), "Accept-Encoding")
+				if coding != "" {
+					servePath, serveStats = sidecarPath, sidecarStats
+					w.Header().Set("Content-Encoding", coding)
 				}
 			}
-			// File exists and is static, serve
-			f, err := os.Open(filePath)
+			f, err := os.Open(servePath)
 			if err != nil {
 				// File exists but failed to open, server error
 				fmt.Printf("[Legacy] Error reading file '%s': %s\n", filePath, err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return true
 			}
 			defer f.Close()
-			fmt.Printf("[Legacy] Serving exact file: %s\n", filepath.ToSlash(filePath))
-			successCloser(io.NopCloser(f), filePath, stats.ModTime().Format(time.RFC1123))
-			return
+			fmt.Printf("[Legacy] Serving exact file: %s\n", filepath.ToSlash(servePath))
+			w.Header().Set("ZIPSVR_FILENAME", filePath)
+			w.Header().Set("ETag", fileETag(serveStats))
+			// Answers Range, If-Range, If-None-Match and If-Modified-Since
+			http.ServeContent(w, r, filePath, serveStats.ModTime(), f)
+			return true
 		}
 	}
+	return false
+}
 
-	client := &http.Client{
-		Timeout: time.Second * 10,
-	}
-
-	// 2. Online Server
-	if serverSettings.UseInfinityServer {
-		serverUrl := strings.TrimRight(serverSettings.InfinityServerURL, "/")
-		for _, filePath := range append(exactFilePaths, indexFilePaths...) {
+// Serves a file from the Infinity server, or the mirrors in externalFilePaths when it doesn't
+// respond, saving it to htdocs when cache is set.
+// Returns false without writing anything if no mirror has it.
+func serveLegacyInfinity(w http.ResponseWriter, r *http.Request, settings *ServerSettings, paths *legacyPaths, client *http.Client, cache bool) bool {
+	for _, serverUrl := range onlineMirrors(settings) {
+	tryPaths:
+		for _, filePath := range append(paths.exactFilePaths, paths.indexFilePaths...) {
 			// Do not attempt to run server side scripts
-			if isScriptFile(filePath) {
+			if isScriptFile(settings, filePath) {
 				continue
 			}
 			// Create a new request to the online server
-			relPath, err := filepath.Rel(serverSettings.LegacyHTDOCSPath, filePath)
+			relPath, err := filepath.Rel(settings.LegacyHTDOCSPath, filePath)
 			if err != nil {
 				fmt.Printf("[Legacy] Error getting relative path for Infinity request: %s\n", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return true
 			}
 			url := serverUrl + "/" + strings.ReplaceAll(relPath, string([]rune{'\\'}), "/")
-			liveReq, err := http.NewRequest("GET", url, nil)
+			ctx, detach, cancel := liveRequestContext(r.Context())
+			liveReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 			if err != nil {
+				cancel()
 				fmt.Printf("[Legacy] Error creating Infinity request: %s\n", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return true
 			}
 			liveReq.Header.Set("User-Agent", "Flashpoint Game Server")
 			// Perform request
 			resp, err := DoWebRequest(liveReq, client, 0)
 			// If 200, serve and save
 			if err == nil {
-				serveLiveResponse(w, resp, filePath, successCloser, "Infinity")
-				return
+				if cache {
+					detach()
+				}
+				serveLiveResponse(w, resp, filePath, "Infinity ("+serverUrl+")", cache)
+				cancel()
+				return true
+			}
+			cancel()
+			if resp != nil {
+				// The mirror is up but doesn't have this path
+				resp.Body.Close()
+				continue
+			}
+			if r.Context().Err() != nil {
+				// The request was cancelled, not the mirror's fault
+				return false
 			}
+			// No response at all, move on to the next mirror
+			demoteMirror(serverUrl, err)
+			break tryPaths
 		}
 	}
+	return false
+}
 
-	// 3. Special Behaviour (MAD4FP)
-	if serverSettings.UseMad4FP {
-		// Do not attempt to run server side scripts
-		if !isScriptUrl(r.URL) {
-			// Clone the entire request, to keep headers intact for better scraping
-			liveReq := r.Clone(r.Context())
-			liveReq.Header.Set("User-Agent", "Flashpoint Game Server MAD4FP")
-			// Perform request
-			resp, err := DoWebRequest(liveReq, client, 0)
-			// If 200, serve and save
-			if err == nil {
-				serveLiveResponse(w, resp, exactContentPath, successCloser, "MAD4FP")
-				return
-			}
+// Fetches the file from the real website, saving it to htdocs/content when cache is set.
+// Returns false without writing anything if the website doesn't have it.
+func serveLegacyMad4fp(w http.ResponseWriter, r *http.Request, settings *ServerSettings, paths *legacyPaths, client *http.Client, cache bool) bool {
+	// Do not attempt to run server side scripts
+	if isScriptUrl(settings, r.URL) {
+		return false
+	}
+	// Clone the entire request, to keep headers intact for better scraping
+	ctx, detach, cancel := liveRequestContext(r.Context())
+	defer cancel()
+	liveReq := r.Clone(ctx)
+	liveReq.RequestURI = ""
+	liveReq.Header.Set("User-Agent", "Flashpoint Game Server MAD4FP")
+	// Always fetch the whole file so it can be saved, ranges and conditions are answered afterwards
+	for _, header := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		liveReq.Header.Del(header)
+	}
+	// Perform request
+	resp, err := DoWebRequest(liveReq, client, 0)
+	// If 200, serve and save
+	if err == nil {
+		if cache {
+			detach()
 		}
+		serveLiveResponse(w, resp, paths.exactContentPath, "MAD4FP", cache)
+		return true
 	}
-
-	// No response from any method, assume not found
-	fmt.Printf("[Legacy] 404 Not Found: %s\n", r.URL)
-	http.NotFound(w, r)
+	return false
 }
 
-// Serves a response from a live server, and saves the response body to the originally requested file
-func serveLiveResponse(w http.ResponseWriter, resp *http.Response, filePath string, successCloser func(io.ReadCloser, string, string), sourceName string) {
+// Serves a response from a live server. With cache set the body is saved to the originally
+// requested file as it's streamed to the client.
+func serveLiveResponse(w http.ResponseWriter, resp *http.Response, filePath string, sourceName string, cache bool) {
 	defer resp.Body.Close()
 	lastModified := resp.Header.Get("Last-Modified")
-	// Duplicate response body
-	contents, err := io.ReadAll(resp.Body)
+	modifiedTime, err := time.Parse(time.RFC1123, lastModified)
 	if err != nil {
-		fmt.Printf("[Legacy] Error reading %s response body: %s\n", sourceName, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// No last modified found, just use current time
+		lastModified = time.Now().Format(time.RFC1123)
+		modifiedTime = time.Time{}
+	}
+	if !cache {
+		fmt.Printf("[Legacy] Serving %s file without saving: %s\n", sourceName, filepath.ToSlash(filePath))
+		w.Header().Set("Last-Modified", lastModified)
+		if resp.ContentLength >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, resp.Body)
 		return
 	}
-	// Save file
+	// Download next to the real file, so a partial download is never served
 	err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
 	if err != nil {
 		fmt.Printf("[Legacy] Error saving %s response, cannot make directory: %s\n", sourceName, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	file, err := os.Create(filePath)
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.part")
 	if err != nil {
 		fmt.Printf("[Legacy] Error saving %s response, cannot create file: %s\n", sourceName, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
-	_, err = io.Copy(file, bytes.NewReader(contents))
+
+	fmt.Printf("[Legacy] Serving %s file: %s\n", sourceName, filepath.ToSlash(filePath))
+	w.Header().Set("Last-Modified", lastModified)
+	w.Header().Set("ZIPSVR_FILENAME", filePath)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	err = copyToClientAndFile(w, file, resp.Body)
+	file.Close()
 	if err != nil {
 		fmt.Printf("[Legacy] Error saving %s response, cannot write file: %s\n", sourceName, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		os.Remove(file.Name())
 		return
 	}
-	if resp.Header.Get("Last-Modified") != "" {
-		// Convert header to real time
-		modifiedTime, err := time.Parse(time.RFC1123, lastModified)
-		if err == nil {
-			// Date converted successfuly, set time on file and return with response
-			err = os.Chtimes(filePath, time.Now(), modifiedTime)
-			if err != nil {
-				fmt.Printf("[Legacy] Error saving %s response, cannot set modified time: %s\n", sourceName, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+	err = os.Rename(file.Name(), filePath)
+	if err != nil {
+		fmt.Printf("[Legacy] Error saving %s response, cannot move file: %s\n", sourceName, err)
+		os.Remove(file.Name())
+		return
+	}
+	if !modifiedTime.IsZero() {
+		err = os.Chtimes(filePath, time.Now(), modifiedTime)
+		if err != nil {
+			fmt.Printf("[Legacy] Error saving %s response, cannot set modified time: %s\n", sourceName, err)
+		}
+	}
+}
+
+// Copies src to both the client and a file. If the client goes away the file is still
+// finished, so the download isn't wasted. The download must be on a detached context
+// from liveRequestContext for this, or src fails along with the client.
+func copyToClientAndFile(client io.Writer, file io.Writer, src io.Reader) error {
+	buf := make([]byte, 32*1024)
+	clientConnected := true
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			_, writeErr := file.Write(buf[:n])
+			if writeErr != nil {
+				return writeErr
 			}
-			fmt.Printf("[Legacy] Serving %s file: %s\n", sourceName, filepath.ToSlash(filePath))
-			successCloser(io.NopCloser(bytes.NewReader(contents)), filePath, lastModified)
-			return
+			if clientConnected {
+				_, writeErr = client.Write(buf[:n])
+				clientConnected = writeErr == nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 	}
-	// No last modified found, just use current time
-	successCloser(io.NopCloser(bytes.NewReader(contents)), filePath, time.Now().Format(time.RFC1123))
 }
 
 // Treats non-200 responses as errors, and handles 429 responses with a retry timer
@@ -258,8 +403,8 @@ func DoWebRequest(r *http.Request, client *http.Client, depth int) (*http.Respon
 	return resp, fmt.Errorf(resp.Status)
 }
 
-func isScriptFile(filePath string) bool {
-	for _, ext := range serverSettings.ExtScriptTypes {
+func isScriptFile(settings *ServerSettings, filePath string) bool {
+	for _, ext := range settings.ExtScriptTypes {
 		if filepath.Ext(filePath) == "."+ext {
 			return true
 		}
@@ -267,8 +412,8 @@ func isScriptFile(filePath string) bool {
 	return false
 }
 
-func isScriptUrl(u *url.URL) bool {
-	for _, ext := range serverSettings.ExtScriptTypes {
+func isScriptUrl(settings *ServerSettings, u *url.URL) bool {
+	for _, ext := range settings.ExtScriptTypes {
 		if filepath.Ext(u.Path) == "."+ext {
 			return true
 		}
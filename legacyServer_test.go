@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type legacyServerTestResponse struct {
@@ -72,13 +73,32 @@ func setup(settings *ServerSettings) {
 	if err != nil {
 		panic(err)
 	}
-	serverSettings = *settings
+	current := *settings
+	storeSettings(&current)
+}
+
+// Serves a request through the legacy content sources the current settings turn on, in their
+// usual order
+func serveTestLegacyRequest(r *http.Request) *http.Response {
+	settings := *currentSettings()
+	settings.ContentSources = []ContentSourceOptions{{Name: "legacy", Enabled: true, Cache: true}}
+	if settings.UseInfinityServer {
+		settings.ContentSources = append(settings.ContentSources, ContentSourceOptions{Name: "infinity", Enabled: true, Cache: true})
+	}
+	if settings.UseMad4FP {
+		settings.ContentSources = append(settings.ContentSources, ContentSourceOptions{Name: "mad4fp", Enabled: true, Cache: true})
+	}
+	body, err := newReplayableBody(r.Body)
+	if err != nil {
+		panic(err)
+	}
+	resp := serveContent(&settings, r, body)
+	resp.Body = &onCloseBody{ReadCloser: resp.Body, onClose: func() { body.Close() }}
+	return resp
 }
 
 func (test *legacyServerTest) run() error {
-	writer := httptest.NewRecorder()
-	ServeLegacy(writer, test.request)
-	res := writer.Result()
+	res := serveTestLegacyRequest(test.request)
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return fmt.Errorf("failed to read body %s", err)
@@ -429,6 +449,141 @@ func TestServeLegacyOnline200Index(t *testing.T) {
 	}
 }
 
+func TestServeLegacyOnlineLocal200(t *testing.T) {
+	testData := bytes.Repeat([]byte("streamed "), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/example.com/big.swf" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 UTC")
+		w.Write(testData)
+	}))
+	defer server.Close()
+
+	settings := testServerSettings
+	settings.UseInfinityServer = true
+	settings.InfinityServerURL = server.URL
+	setup(&settings)
+	// Keep the download out of the source tree
+	settings.LegacyHTDOCSPath = t.TempDir()
+	storeSettings(&settings)
+
+	savedFile := path.Join(settings.LegacyHTDOCSPath, "example.com", "big.swf")
+	test := &legacyServerTest{
+		request: makeNewRequest("GET", "http://example.com/big.swf", nil),
+		response: &legacyServerTestResponse{
+			statusCode: http.StatusOK,
+			body:       testData,
+			savedFile:  &savedFile,
+		},
+	}
+
+	err := test.run()
+	if err != nil {
+		t.Error(err)
+	}
+	saved, err := os.ReadFile(savedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, testData) {
+		t.Errorf("expected saved file to match the download, got %d bytes", len(saved))
+	}
+}
+
+func TestServeLegacyOnlineCachesAfterClientLeaves(t *testing.T) {
+	firstPart := bytes.Repeat([]byte("first "), 10000)
+	secondPart := bytes.Repeat([]byte("second "), 10000)
+	clientGone := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(firstPart)+len(secondPart)))
+		w.Write(firstPart)
+		w.(http.Flusher).Flush()
+		// Only send the rest once the client has dropped
+		<-clientGone
+		w.Write(secondPart)
+	}))
+	defer server.Close()
+
+	settings := testServerSettings
+	settings.UseInfinityServer = true
+	settings.InfinityServerURL = server.URL
+	setup(&settings)
+	// Keep the download out of the source tree
+	settings.LegacyHTDOCSPath = t.TempDir()
+	storeSettings(&settings)
+
+	resp := serveTestLegacyRequest(makeNewRequest("GET", "http://example.com/dropped.swf", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	_, err := io.ReadFull(resp.Body, make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing the body cancels the request, as it does when the client goes away
+	resp.Body.Close()
+	close(clientGone)
+
+	savedFile := path.Join(settings.LegacyHTDOCSPath, "example.com", "dropped.swf")
+	expected := append(firstPart, secondPart...)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		saved, err := os.ReadFile(savedFile)
+		if err == nil {
+			if !bytes.Equal(saved, expected) {
+				t.Errorf("expected saved file to match the download, got %d bytes", len(saved))
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected file %s to be saved after the client left, got error %s", savedFile, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeLegacyOnlineMirrorFailover(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/htdocs/example.com/mirrored.swf" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("mirrored swf"))
+	}))
+	defer server.Close()
+	// Nothing listens on a closed server's address
+	deadServer := httptest.NewServer(http.NotFoundHandler())
+	deadServer.Close()
+
+	settings := testServerSettings
+	settings.UseInfinityServer = true
+	settings.InfinityServerURL = deadServer.URL
+	settings.ExternalFilePaths = []string{deadServer.URL + "/", server.URL + "/htdocs"}
+	setup(&settings)
+	// Keep the download out of the source tree
+	settings.LegacyHTDOCSPath = t.TempDir()
+	storeSettings(&settings)
+
+	test := &legacyServerTest{
+		request: makeNewRequest("GET", "http://example.com/mirrored.swf", nil),
+		response: &legacyServerTestResponse{
+			statusCode: http.StatusOK,
+			body:       []byte("mirrored swf"),
+		},
+	}
+	err := test.run()
+	if err != nil {
+		t.Error(err)
+	}
+
+	mirrors := onlineMirrors(&settings)
+	if len(mirrors) != 2 || mirrors[0] != server.URL+"/htdocs" || mirrors[1] != deadServer.URL {
+		t.Errorf("expected the dead mirror to be demoted, got %v", mirrors)
+	}
+}
+
 func TestServeLegacyDisabledMad4fp(t *testing.T) {
 	setup(&testServerSettings)
 
@@ -472,3 +627,40 @@ func makeNewRequest(method string, url string, body io.Reader) *http.Request {
 	}
 	return request
 }
+
+func TestOnlineClientTimesOutIdleOnly(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			if r.URL.Path == "/stalled" {
+				time.Sleep(time.Second)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	client := newOnlineClient(300 * time.Millisecond)
+
+	// Takes longer than the timeout in total, but never waits that long for the next chunk
+	resp, err := client.Get(server.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != strings.Repeat("chunk", 5) {
+		t.Errorf("expected a slow download to finish, got %q %v", body, err)
+	}
+
+	resp, err = client.Get(server.URL + "/stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		t.Error("expected a stalled download to time out")
+	}
+}
@@ -1,25 +1,18 @@
 package main
 
 import (
-	"bytes"
-	"context"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httptest"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
-	"time"
 
-	"github.com/FlashpointProject/zipfs"
 	"github.com/elazarl/goproxy"
 )
 
@@ -48,13 +41,94 @@ type ServerSettings struct {
 	ExtIndexTypes        []string          `json:"extIndexTypes"`
 	ExtGzippeddTypes     []string          `json:"extGzippedTypes"`
 	ExtMimeTypes         map[string]string `json:"extMimeTypes"`
+	// Extra hosts to look for content under, see hostAliases.go
+	HostAliases map[string]string `json:"hostAliases"`
+	// Origins allowed to make cross-origin requests to each host, see cors.go
+	CorsAllowedOrigins map[string][]string `json:"corsAllowedOrigins"`
+	// Referer, Origin and embedding page fixes for sitelocked games, see sitelock.go
+	Sitelocks map[string]SitelockOptions `json:"sitelocks"`
+	// WebSocket endpoints emulated or passed through for each host, see websocket.go
+	Websockets map[string]WebsocketEndpoint `json:"websockets"`
+	// Emulated XMLSocket and raw TCP servers by port, see socketServers.go
+	SocketServers map[string]SocketServerOptions `json:"socketServers"`
+	// Serve Flash socket policies on SocketPolicyPort, see socketPolicy.go
+	EnableSocketPolicyServer bool   `json:"enableSocketPolicyServer"`
+	SocketPolicyPort         string `json:"socketPolicyPort"`
+	// SOCKS5 listener alongside the HTTP proxy, off when empty, see socks.go
+	SocksPort string `json:"socksPort"`
+	// Listener for clients that can't use a proxy, off when empty, see reverseProxy.go
+	ReverseProxyPort string `json:"reverseProxyPort"`
+	// Send every host through the proxy in the PAC script, see pac.go
+	PacProxyAll bool `json:"pacProxyAll"`
+	// Gzip responses on the fly for clients that accept it, see compression.go
+	CompressResponses bool     `json:"compressResponses"`
+	CompressMinSize   int64    `json:"compressMinSize"`
+	CompressMimeTypes []string `json:"compressMimeTypes"`
+	// Let the type sniffed from the body replace the extension's, see contentSniffing.go
+	SniffOverridesExtension bool `json:"sniffOverridesExtension"`
+	// Sources tried for each request in order, see contentSources.go
+	ContentSources []ContentSourceOptions `json:"contentSources"`
+	// Named sets of settings that can be activated for a game, see profiles.go
+	Profiles map[string]map[string]json.RawMessage `json:"profiles"`
 }
 
-// ExtApplicationTypes is a map that holds the content types of different file extensions
-var serverSettings ServerSettings
 var proxy *goproxy.ProxyHttpServer
 var cwd string
 
+// Serves GameZIP content and the zipfs API, called in-process by the proxy
+var zipServer http.Handler
+
+// Flags that are named differently to the setting they override, kept so older launchers still work
+var settingsFlagAliases = map[string]string{
+	"gameRootPath":   "gameDataPath",
+	"serverHttpPort": "serverHTTPPort",
+	"UseMad4FP":      "useMad4FP",
+}
+
+// Descriptions used in the command line help, keyed by setting
+// TODO: Improve descriptions
+var settingsDescriptions = map[string]string{
+	"rootPath":                 "The path that other relative paths use as a base",
+	"gameDataPath":             "This is the path where to find the zips",
+	"legacyPHPPath":            "This is the path for PHP",
+	"legacyCGIBINPath":         "This is the path for CGI-BIN",
+	"legacyHTDOCSPath":         "This is the path for HTDOCS",
+	"phpCgiPath":               "Path to PHP CGI executable",
+	"useInfinityServer":        "Whether to use the infinity server or not",
+	"infinityServerURL":        "The URL of the infinity server",
+	"handleLegacyRequests":     "Whether to handle legacy requests internally (true) or externally (false)",
+	"externalLegacyPort":       "The port that the external legacy server is running on (if handling legacy is disabled).",
+	"proxyPort":                "proxy listen port",
+	"serverHTTPPort":           "zip server http listen port",
+	"useMad4FP":                "flag to turn on/off Mad4FP.",
+	"enableHttpsProxy":         "Whether to enable HTTPS proxying or not",
+	"allowCrossDomain":         "Whether to allow cross-domain requests, with CORS headers and synthesized policy files",
+	"enableSocketPolicyServer": "Whether to serve Flash socket policies on socketPolicyPort",
+	"socketPolicyPort":         "Port to serve Flash socket policies on, Flash Player asks on 843",
+	"socksPort":                "Port to serve SOCKS5 on, empty to disable it",
+	"reverseProxyPort":         "Port to serve requests on by their Host header, for clients that can't use a proxy, empty to disable it",
+	"pacProxyAll":              "Whether the PAC script sends every host through the proxy, instead of only hosts with local content",
+	"compressResponses":        "Whether to gzip responses of compressMimeTypes for clients that accept it",
+	"compressMinSize":          "Smallest response in bytes that compressResponses gzips",
+	"compressMimeTypes":        "Comma separated media types gzipped by compressResponses, may end in /* to match any subtype",
+	"sniffOverridesExtension":  "Whether a content type recognised from the body replaces the one from the extension, instead of only filling in a missing one",
+	"verboseLogging":           "should every proxy request be logged to stdout",
+	"apiPrefix":                "apiPrefix is used to prefix any API call.",
+	"overridePaths":            "Comma separated paths checked for files before the zips",
+	"legacyOverridePaths":      "Comma separated paths checked for files before htdocs",
+	"externalFilePaths":        "Comma separated list of online mirrors",
+	"extScriptTypes":           "Comma separated extensions run as scripts",
+	"extIndexTypes":            "Comma separated extensions used for directory index files",
+	"extGzippedTypes":          "Comma separated extensions that are served gzip encoded",
+	"extMimeTypes":             "Comma separated ext=mime pairs, merged into the mime types",
+	"hostAliases":              "Comma separated host=alias pairs, hosts may start with *. to match any subdomain",
+	"corsAllowedOrigins":       "Json object of the origins allowed for each host, when allowCrossDomain is on",
+	"sitelocks":                "Json object of sitelock fixes keyed by host",
+	"websockets":               "Json object of WebSocket endpoints keyed by host (echo, replay, transcript or passthrough)",
+	"contentSources":           "Comma separated content sources tried in order (zip, legacy, infinity, mad4fp, external), empty uses the default order",
+	"profiles":                 "Json object of named settings profiles",
+}
+
 func initServer() {
 	// Get the CWD of this application
 	exe, err := os.Executable()
@@ -63,103 +137,95 @@ func initServer() {
 	}
 	cwd = filepath.Dir(exe)
 
-	// Load the content types from the JSON file
-	data, err := os.ReadFile(filepath.Join(cwd, "proxySettings.json"))
+	// Get all of the parameters passed in, only flags given explicitly override the other layers
+	registerSettingsFlags(flag.CommandLine, settingsDescriptions, settingsFlagAliases)
+	printConfig := flag.Bool("print-config", false, "Print each effective setting and the layer it came from, then exit")
+
+	flag.Parse()
+
+	settings, sources, err := loadServerSettings()
+	// Printed before any problems, as they're easier to fix knowing which layer each value came from
+	if *printConfig && settings != nil {
+		printSettings(os.Stdout, settings, sources)
+	}
 	if err != nil {
-		panic(err)
+		exitWithSettingsError(os.Stderr, err)
 	}
-
-	// Unmarshal the JSON data into a Config struct
-	err = json.Unmarshal(data, &serverSettings)
+	if *printConfig {
+		os.Exit(0)
+	}
+	storeSettings(settings)
+	rules, err := loadRewriteRules(rewriteRulesFilePath())
 	if err != nil {
-		panic(err)
+		exitWithSettingsError(os.Stderr, err)
 	}
+	rewriteRulesValue.Store(rules)
 
-	// Get all of the parameters passed in
-	// TODO: Figure out a way to (partially?) automate everything that's going on below
-	// TODO: Improve descriptions
-	rootPath := flag.String("rootPath", serverSettings.RootPath, "The path that other relative paths use as a base")
-	gameDataPath := flag.String("gameRootPath", serverSettings.GameDataPath, "This is the path where to find the zips")
-	legacyPHPPath := flag.String("legacyPHPPath", serverSettings.LegacyPHPPath, "This is the path for PHP")
-	legacyCGIBINPath := flag.String("legacyCGIBINPath", serverSettings.LegacyCGIBINPath, "This is the path for CGI-BIN")
-	legacyHTDOCSPath := flag.String("legacyHTDOCSPath", serverSettings.LegacyHTDOCSPath, "This is the path for HTDOCS")
-	phpCgiPath := flag.String("phpCgiPath", serverSettings.PhpCgiPath, "Path to PHP CGI executable")
-	useInfinityServer := flag.Bool("useInfinityServer", serverSettings.UseInfinityServer, "Whether to use the infinity server or not")
-	infinityServerURL := flag.String("infinityServerURL", serverSettings.InfinityServerURL, "The URL of the infinity server")
-	handleLegacyRequests := flag.Bool("handleLegacyRequests", serverSettings.HandleLegacyRequests, "Whether to handle legacy requests internally (true) or externally (false)")
-	externalLegacyPort := flag.String("externalLegacyPort", serverSettings.ExternalLegacyPort, "The port that the external legacy server is running on (if handling legacy is disabled).")
-	proxyPort := flag.String("proxyPort", serverSettings.ProxyPort, "proxy listen port")
-	serverHttpPort := flag.String("serverHttpPort", serverSettings.ServerHTTPPort, "zip server http listen port")
-	useMad4FP := flag.Bool("UseMad4FP", serverSettings.UseMad4FP, "flag to turn on/off Mad4FP.")
-	enableHttpsProxy := flag.Bool("enableHttpsProxy", serverSettings.EnableHttpsProxy, "Whether to enable HTTPS proxying or not")
-	allowCrossDomain := flag.Bool("allowCrossDomain", serverSettings.AllowCrossDomain, "Whether to allow cross-domain requests")
-	verboseLogging := flag.Bool("verboseLogging", serverSettings.VerboseLogging, "should every proxy request be logged to stdout")
-	apiPrefix := flag.String("apiPrefix", serverSettings.ApiPrefix, "apiPrefix is used to prefix any API call.")
+	// Print out all path settings
+	fmt.Println("Root Path:", settings.RootPath)
+	fmt.Println("Game Data Path:", settings.GameDataPath)
+	fmt.Println("Legacy PHP Path:", settings.LegacyPHPPath)
+	fmt.Println("Legacy CGI-BIN Path:", settings.LegacyCGIBINPath)
+	fmt.Println("Legacy HTDOCS Path:", settings.LegacyHTDOCSPath)
+	fmt.Println("PHP-CGI Path:", settings.PhpCgiPath)
 
-	flag.Parse()
+	// Setup the proxy
+	proxy = goproxy.NewProxyHttpServer()
+	proxy.Verbose = settings.VerboseLogging
+	fmt.Println("Proxy Server started on port", settings.ProxyPort)
+	fmt.Println("Zip Server started on port", settings.ServerHTTPPort)
+}
 
-	// Apply all of the flags to the settings
-	serverSettings.RootPath, err = filepath.Abs(strings.Trim(*rootPath, "\""))
+// Resolves all path settings to absolute paths, relative paths are based on the root path.
+// Paths that are already absolute are kept, so resolving twice gives the same result.
+func resolveSettingsPaths(settings *ServerSettings) error {
+	var err error
+	settings.RootPath, err = filepath.Abs(strings.Trim(settings.RootPath, "\""))
 	if err != nil {
-		fmt.Println("Failed to get absolute root path")
-		panic(err)
+		return fmt.Errorf("failed to get absolute root path: %w", err)
 	}
-	serverSettings.GameDataPath, err = filepath.Abs(path.Join(serverSettings.RootPath, strings.Trim(*gameDataPath, "\"")))
+	settings.GameDataPath, err = resolveSettingPath(settings.RootPath, settings.GameDataPath)
 	if err != nil {
-		fmt.Println("Failed to get absolute game data path")
-		panic(err)
+		return fmt.Errorf("failed to get absolute game data path: %w", err)
 	}
-	serverSettings.LegacyPHPPath, err = filepath.Abs(path.Join(serverSettings.RootPath, strings.Trim(*legacyPHPPath, "\"")))
+	settings.LegacyPHPPath, err = resolveSettingPath(settings.RootPath, settings.LegacyPHPPath)
 	if err != nil {
-		fmt.Println("Failed to get absolute PHP path")
-		panic(err)
+		return fmt.Errorf("failed to get absolute PHP path: %w", err)
 	}
-	serverSettings.LegacyCGIBINPath, err = filepath.Abs(path.Join(serverSettings.RootPath, strings.Trim(*legacyCGIBINPath, "\"")))
+	settings.LegacyCGIBINPath, err = resolveSettingPath(settings.RootPath, settings.LegacyCGIBINPath)
 	if err != nil {
-		fmt.Println("Failed to get absolute cgi-bin path")
-		panic(err)
+		return fmt.Errorf("failed to get absolute cgi-bin path: %w", err)
 	}
-	serverSettings.LegacyHTDOCSPath, err = filepath.Abs(path.Join(serverSettings.RootPath, strings.Trim(*legacyHTDOCSPath, "\"")))
+	settings.LegacyHTDOCSPath, err = resolveSettingPath(settings.RootPath, settings.LegacyHTDOCSPath)
 	if err != nil {
-		fmt.Println("Failed to get absolute htdocs path")
-		panic(err)
+		return fmt.Errorf("failed to get absolute htdocs path: %w", err)
 	}
-	serverSettings.PhpCgiPath, err = filepath.Abs(path.Join(serverSettings.RootPath, strings.Trim(*phpCgiPath, "\"")))
-	if err != nil {
-		fmt.Println("Failed to get absolute PHP-CGI path")
-		panic(err)
+	// Left empty on installs without PHP, rather than becoming the root path
+	if settings.PhpCgiPath != "" {
+		settings.PhpCgiPath, err = resolveSettingPath(settings.RootPath, settings.PhpCgiPath)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute PHP-CGI path: %w", err)
+		}
 	}
-	serverSettings.UseInfinityServer = *useInfinityServer
-	serverSettings.InfinityServerURL = *infinityServerURL
-	serverSettings.HandleLegacyRequests = *handleLegacyRequests
-	serverSettings.ExternalLegacyPort = *externalLegacyPort
-	serverSettings.ProxyPort = *proxyPort
-	serverSettings.ServerHTTPPort = *serverHttpPort
-	serverSettings.UseMad4FP = *useMad4FP
-	serverSettings.EnableHttpsProxy = *enableHttpsProxy
-	serverSettings.AllowCrossDomain = *allowCrossDomain
-	serverSettings.VerboseLogging = *verboseLogging
-	serverSettings.ApiPrefix = *apiPrefix
-
-	// Print out all path settings
-	fmt.Println("Root Path:", serverSettings.RootPath)
-	fmt.Println("Game Data Path:", serverSettings.GameDataPath)
-	fmt.Println("Legacy PHP Path:", serverSettings.LegacyPHPPath)
-	fmt.Println("Legacy CGI-BIN Path:", serverSettings.LegacyCGIBINPath)
-	fmt.Println("Legacy HTDOCS Path:", serverSettings.LegacyHTDOCSPath)
-	fmt.Println("PHP-CGI Path:", serverSettings.PhpCgiPath)
+	return nil
+}
 
-	// Setup the proxy
-	proxy = goproxy.NewProxyHttpServer()
-	proxy.Verbose = serverSettings.VerboseLogging
-	fmt.Println("Proxy Server started on port", serverSettings.ProxyPort)
-	fmt.Println("Zip Server started on port", serverSettings.ServerHTTPPort)
+func resolveSettingPath(rootPath string, settingPath string) (string, error) {
+	settingPath = strings.Trim(settingPath, "\"")
+	if filepath.IsAbs(settingPath) {
+		return filepath.Clean(settingPath), nil
+	}
+	return filepath.Abs(path.Join(rootPath, settingPath))
 }
 
-func setContentType(r *http.Request, resp *http.Response) {
+func setContentType(settings *ServerSettings, r *http.Request, resp *http.Response) {
 	if r == nil || resp == nil {
 		return
 	}
+	// Error pages, such as backend diagnostics, describe themselves rather than the requested file
+	if resp.StatusCode >= 400 && resp.Header.Get("Content-Type") != "" {
+		return
+	}
 
 	resp.Header.Del("Content-Type")
 
@@ -169,15 +235,17 @@ func setContentType(r *http.Request, resp *http.Response) {
 
 	// If the request already has an extension, fetch the mime via extension
 	if ext != "" {
-		resp.Header.Set("Content-Type", serverSettings.ExtMimeTypes[ext[1:]])
-		mime = serverSettings.ExtMimeTypes[ext[1:]]
+		resp.Header.Set("Content-Type", settings.ExtMimeTypes[ext[1:]])
+		mime = settings.ExtMimeTypes[ext[1:]]
 		if mime != "" && len(ext) > 1 {
 			resp.Header.Set("Content-Type", mime)
 			e := ext[1:]
-			// If pre-compressed set encoding type
-			for _, element := range serverSettings.ExtGzippeddTypes {
+			// If pre-compressed set encoding type, unless it's already set by a sidecar
+			for _, element := range settings.ExtGzippeddTypes {
 				if element == e {
-					resp.Header.Set("Content-Encoding", "gzip")
+					if resp.Header.Get("Content-Encoding") == "" {
+						resp.Header.Set("Content-Encoding", "gzip")
+					}
 					break // String found, no need to continue iterating
 				}
 			}
@@ -186,21 +254,30 @@ func setContentType(r *http.Request, resp *http.Response) {
 
 	// If the response has an extension, try and fetch the mime for that via extension
 	if mime == "" && rext != "" {
-		resp.Header.Set("Content-Type", serverSettings.ExtMimeTypes[rext[1:]])
-		mime = serverSettings.ExtMimeTypes[rext[1:]]
+		resp.Header.Set("Content-Type", settings.ExtMimeTypes[rext[1:]])
+		mime = settings.ExtMimeTypes[rext[1:]]
 		if mime != "" && len(rext) > 1 {
 			resp.Header.Set("Content-Type", mime)
 			e := rext[1:]
-			// If pre-compressed set encoding type
-			for _, element := range serverSettings.ExtGzippeddTypes {
+			// If pre-compressed set encoding type, unless it's already set by a sidecar
+			for _, element := range settings.ExtGzippeddTypes {
 				if element == e {
-					resp.Header.Set("Content-Encoding", "gzip")
+					if resp.Header.Get("Content-Encoding") == "" {
+						resp.Header.Set("Content-Encoding", "gzip")
+					}
 					break // String found, no need to continue iterating
 				}
 			}
 		}
 	}
 
+	// Look at the body when the extension gives no type, or might be wrong
+	if mime == "" || settings.SniffOverridesExtension {
+		if sniffed := sniffContentType(settings, r, resp, mime); sniffed != "" {
+			mime = sniffed
+		}
+	}
+
 	// Set content type header
 	if mime != "" {
 		resp.Header.Set("Content-Type", mime)
@@ -208,98 +285,52 @@ func setContentType(r *http.Request, resp *http.Response) {
 }
 
 func handleRequest(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-	// Remove port from host if exists (old apps don't clean it before sending requests?)
-	r.URL.Host = strings.Split(r.URL.Host, ":")[0]
-	// Clone the body into both requests by reading and making 2 new readers
-	contents, _ := io.ReadAll(r.Body)
-
-	// Copy the original request
-	gamezipRequest := &http.Request{
-		Method: r.Method,
-		URL: &url.URL{
-			Scheme:   "http",
-			Host:     "127.0.0.1:" + serverSettings.ServerHTTPPort,
-			Path:     "content/" + r.URL.Host + r.URL.Path,
-			RawQuery: r.URL.RawQuery,
-		},
-		Header: r.Header,
-		Body:   nil,
-	}
-	gamezipRequest.Body = io.NopCloser(bytes.NewReader(contents))
-
-	// Make the request to the zip server.
-	client := &http.Client{}
-	proxyReq, err := http.NewRequest(gamezipRequest.Method, gamezipRequest.URL.String(), gamezipRequest.Body)
-	if err != nil {
-		fmt.Printf("UNHANDLED GAMEZIP ERROR: %s\n", err)
-	}
-	proxyReq.Header = gamezipRequest.Header
-
-	proxyResp, err := client.Do(proxyReq)
+	// Remove port from host if exists (old apps don't clean it before sending requests?),
+	// lookups still try host_port/ first
+	r = stripRequestPort(r)
+	// Use the same settings for the whole request, even if they are reloaded part way through
+	settings := currentSettings()
+	// Keep the body so it can be replayed to each source, large bodies are spilled to disk
+	body, err := newReplayableBody(r.Body)
 	if err != nil {
-		fmt.Printf("UNHANDLED GAMEZIP SERVER ERROR: %s\n", err)
+		fmt.Printf("Error reading request body: %s\n", err)
+		body = &replayableBody{}
 	}
-	if proxyResp.StatusCode >= 500 {
-		fmt.Println("Gamezip Server Error: ", proxyResp.StatusCode)
-	}
-
-	// Check Legacy
-	if proxyResp.StatusCode >= 400 {
-		// Copy the original request
-		legacyRequest := &http.Request{
-			Method: r.Method,
-			URL: &url.URL{
-				Scheme:   "http",
-				Host:     r.URL.Host,
-				Path:     r.URL.Path,
-				RawQuery: r.URL.RawQuery,
-			},
-			Header: r.Header,
-			Body:   nil,
-		}
-		// Copy in a new body reader
-		legacyRequest.Body = io.NopCloser(bytes.NewReader(contents))
-
-		// Choose which legacy method we're using
-		if serverSettings.HandleLegacyRequests {
-			// If internal, skip actual networking
-			resRecorder := httptest.NewRecorder()
-			ServeLegacy(resRecorder, legacyRequest)
-			proxyResp = resRecorder.Result()
-		} else {
-			// Set the Proxy URL and apply it to the Transpor layer so that the request respects the proxy.
-			proxyURL, _ := url.Parse("http://127.0.0.1:" + serverSettings.ExternalLegacyPort)
-			proxy := http.ProxyURL(proxyURL)
-			transport := &http.Transport{Proxy: proxy}
-
-			// A custom Dialer is required for the "localflash" urls, instead of using the DNS, we use this.
-			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-				//Set Dialer timeout and keepalive to 30 seconds and force the address to localhost.
-				dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
-				addr = "127.0.0.1:" + serverSettings.ExternalLegacyPort
-				return dialer.DialContext(ctx, network, addr)
-			}
 
-			// Make the request with the custom transport
-			client := &http.Client{Transport: transport, Timeout: 300 * time.Second}
-			legacyResp, err := client.Do(legacyRequest)
-			// An error occured, log it for debug purposes
-			if err == nil {
-				fmt.Printf("\tServing from External Legacy...\n")
-				proxyResp = legacyResp
-			} else {
-				fmt.Printf("UNHANDLED EXTERNAL LEGACY ERROR: %s\n", err)
-			}
+	rules := currentRewriteRules()
+	var proxyResp *http.Response
+	if isCorsPreflight(r) {
+		proxyResp = serveCorsPreflight(r)
+	} else {
+		// Rewrite the request before looking it up, a redirect skips the lookup entirely
+		proxyResp = applyRequestRules(settings, rules, r)
+		if proxyResp == nil {
+			ignoreRangeForGunzip(settings, r)
+			ignoreRangeForReplace(rules, r)
+			// Try each content source in turn
+			proxyResp = serveContent(settings, r, body)
 		}
 	}
 
+	// Remove the spilled request body once the response is done with
+	proxyResp.Body = &onCloseBody{ReadCloser: proxyResp.Body, onClose: func() { body.Close() }}
+
 	// Update the content type based upon ext for now.
-	setContentType(r, proxyResp)
+	setContentType(settings, r, proxyResp)
+
+	// Fill in any missing policy files, after the content type so theirs is kept
+	proxyResp = servePolicyFile(settings, r, proxyResp)
+
+	applyResponseRules(settings, rules, r, proxyResp)
+
+	// Compress or decompress the body for the client, before ranges so they're of what's sent
+	negotiateContentEncoding(settings, r, proxyResp)
+
+	// Answer ranges and conditions for sources that only give whole files
+	proxyResp = applyRangeRequest(r, proxyResp)
 
 	// Add extra headers
-	proxyResp.Header.Set("Access-Control-Allow-Headers", "*")
-	proxyResp.Header.Set("Access-Control-Allow-Methods", "*")
-	proxyResp.Header.Set("Access-Control-Allow-Origin", "*")
+	applyCorsHeaders(settings, r, proxyResp)
 	// Keep Alive
 	if strings.ToLower(r.Header.Get("Connection")) == "keep-alive" {
 		proxyResp.Header.Set("Connection", "Keep-Alive")
@@ -311,6 +342,8 @@ func handleRequest(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http
 
 func main() {
 	initServer()
+	settings := currentSettings()
+	go watchSettingsFiles([]string{settingsFilePath(), userSettingsFilePath(), rewriteRulesFilePath()}, settingsPollInterval)
 	// To create CA cert, refer to https://wiki.mozilla.org/SecurityEngineering/x509Certs#Self_Signed_Certs
 	// Replace CA in GoProxy
 	certData := []byte(`-----BEGIN CERTIFICATE-----
@@ -341,10 +374,12 @@ XgVWIMrKj4T7p86bcxq4jdWDYUYpRd/2Og==
 		panic(err)
 	}
 
-	goproxy.MitmConnect.TLSConfig = goproxy.TLSConfigFromCA(&cert)
+	tlsConfigFor := goproxy.TLSConfigFromCA(&cert)
+	goproxy.MitmConnect.TLSConfig = tlsConfigFor
 
 	// Handle HTTPS requests (DOES NOT HANDLE HTTP)
-	if serverSettings.EnableHttpsProxy {
+	if settings.EnableHttpsProxy {
+		handleWebsocketConnects(proxy, tlsConfigFor)
 		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
 	} else {
 		proxy.OnRequest().HandleConnect(goproxy.AlwaysReject)
@@ -360,28 +395,51 @@ XgVWIMrKj4T7p86bcxq4jdWDYUYpRd/2Og==
 
 	// Handle HTTP requests (DOES NOT HANDLE HTTPS)
 	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		// Leave live WebSockets for goproxy to tunnel
+		if isWebsocketPassthrough(currentSettings(), r) {
+			return r, nil
+		}
 		return handleRequest(r, ctx)
 	})
 
-	// Start ZIP server
+	zipServer = newZipServer(settings)
+
+	// Start ZIP server, the proxy calls the zip server directly so this is only needed for the launcher API
 	go func() {
-		//TODO: Update these to be modifiable in the properties json.
-		//TODO: Also update the "fpProxy/api/" to be in the properties json.
-		log.Fatal(http.ListenAndServe("127.0.0.1:"+serverSettings.ServerHTTPPort,
-			zipfs.EmptyFileServer(
-				serverSettings.ApiPrefix,
-				"",
-				serverSettings.VerboseLogging,
-				serverSettings.ExtIndexTypes,
-				serverSettings.GameDataPath,
-				serverSettings.PhpCgiPath,
-				serverSettings.ExtMimeTypes,
-				serverSettings.OverridePaths,
-				serverSettings.LegacyHTDOCSPath,
-			),
-		))
+		log.Fatal(http.ListenAndServe("127.0.0.1:"+settings.ServerHTTPPort, newApiHandler(settings.ApiPrefix, zipServer)))
 	}()
 
-	// Start proxy server
-	log.Fatal(http.ListenAndServe("127.0.0.1:"+serverSettings.ProxyPort, http.AllowQuerySemicolons(proxy)))
+	// Start socket policy server, a port below 1024 may need admin rights so failing isn't fatal
+	if settings.EnableSocketPolicyServer {
+		go func() {
+			err := listenSocketPolicies("127.0.0.1:" + settings.SocketPolicyPort)
+			fmt.Printf("[Policy] Socket policy server stopped: %s\n", err)
+		}()
+	}
+
+	// Start SOCKS server
+	if settings.SocksPort != "" {
+		go func() {
+			err := listenSocks("127.0.0.1:"+settings.SocksPort, "127.0.0.1:"+settings.ProxyPort)
+			fmt.Printf("[SOCKS] SOCKS server stopped: %s\n", err)
+		}()
+	}
+
+	// Serve requests sent to the proxy as if it were the site, and on their own port if set
+	proxy.NonproxyHandler = newReverseProxyHandler()
+	if settings.ReverseProxyPort != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe("127.0.0.1:"+settings.ReverseProxyPort, proxy.NonproxyHandler))
+		}()
+	}
+
+	// Start the emulated socket servers, they're started and stopped as the settings change after this
+	syncSocketServers(currentSettings())
+
+	// Start proxy server, answering socket policy requests sent to it directly
+	listener, err := net.Listen("tcp", "127.0.0.1:"+settings.ProxyPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(http.Serve(socketPolicyListener{listener}, http.AllowQuerySemicolons(newWebsocketHandler(proxy))))
 }
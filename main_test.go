@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FlashpointProject/zipfs"
+)
+
+// Mounts a GameZIP holding the given files as the zip server
+func setupTestZipServer(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "game.zip")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := zip.NewWriter(zipFile)
+	for name, contents := range files {
+		w, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipFile.Close()
+
+	settings := currentSettings()
+	zipServer = zipfs.EmptyFileServer("fpProxy/api/", "", false, settings.ExtIndexTypes, dir, "", settings.ExtMimeTypes, []string{}, settings.LegacyHTDOCSPath)
+	w := httptest.NewRecorder()
+	zipServer.ServeHTTP(w, makeNewRequest("POST", "http://127.0.0.1/fpProxy/api/mountzip", bytes.NewBufferString(`{"filePath": "game.zip"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to mount test zip: %s", w.Body.String())
+	}
+}
+
+func readTestResponse(t *testing.T, resp *http.Response) []byte {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestHandleRequestZip(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/game.swf": "zipped swf",
+	})
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/game.swf", nil), nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "zipped swf" {
+		t.Errorf("expected zipped file, got %s", body)
+	}
+}
+
+func TestHandleRequestZipFallback(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/game.swf": "zipped swf",
+	})
+	testFile := filepath.Join(settings.LegacyHTDOCSPath, "example.com", "other.swf")
+	err := os.MkdirAll(filepath.Dir(testFile), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(testFile, []byte("legacy swf"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/other.swf", nil), nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "legacy swf" {
+		t.Errorf("expected legacy file, got %s", body)
+	}
+}
+
+func TestHandleRequestExternalLegacyUnreachable(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = false
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{})
+	// Grab a free port and close it again so nothing is listening there
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	current := *currentSettings()
+	current.ExternalLegacyPort = port
+	storeSettings(&current)
+	failures := backendHealthReport()[backendExternalLegacy].Failures
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/missing.swf", nil), nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected status code 502, got %d", resp.StatusCode)
+	}
+	if backend := resp.Header.Get("X-Fpproxy-Backend"); backend != backendExternalLegacy {
+		t.Errorf("expected backend header %s, got %s", backendExternalLegacy, backend)
+	}
+	if !bytes.Contains(body, []byte(backendExternalLegacy)) {
+		t.Errorf("expected diagnostic body naming the backend, got %s", body)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("expected the diagnostic to stay plain text, got %s", contentType)
+	}
+	if backendHealthReport()[backendExternalLegacy].Failures != failures+1 {
+		t.Errorf("expected the failure to be counted")
+	}
+}
+
+func TestBackendErrorResponseTimeout(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/slow.swf", nil)
+	resp := backendErrorResponse(r, backendExternalLegacy, context.DeadlineExceeded)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected status code 504, got %d", resp.StatusCode)
+	}
+}
+
+func TestBackendHealthRecovers(t *testing.T) {
+	previousStats := backendHealthStats
+	backendHealthStats = map[string]*backendHealth{}
+	t.Cleanup(func() { backendHealthStats = previousStats })
+	settings := testServerSettings
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/game.swf": "zipped swf",
+	})
+
+	healthy := func() bool {
+		w := httptest.NewRecorder()
+		serveHealthApi(w, httptest.NewRequest("GET", "http://127.0.0.1/fpProxy/api/health", nil))
+		var report struct {
+			Healthy bool `json:"healthy"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return report.Healthy
+	}
+	recordBackendFailure(backendGameZip, errors.New("failed to read zip"))
+	if healthy() || backendHealthReport()[backendGameZip].Healthy {
+		t.Fatal("expected the failure to make the zip backend unhealthy")
+	}
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/game.swf", nil), nil)
+	readTestResponse(t, resp)
+	if !healthy() {
+		t.Error("expected a success to make the zip backend healthy again")
+	}
+	if health := backendHealthReport()[backendGameZip]; health.Failures != 1 || health.LastSuccess.IsZero() {
+		t.Errorf("expected the failure to still be counted after recovering, got %+v", health)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a mirror that failed to respond is tried after the others
+const mirrorCooldown = 5 * time.Minute
+
+// Health of a single online mirror
+type mirrorHealth struct {
+	Failures     int64     `json:"failures"`
+	LastError    string    `json:"lastError,omitempty"`
+	DemotedUntil time.Time `json:"demotedUntil,omitempty"`
+}
+
+var mirrorHealthMutex sync.Mutex
+var mirrorHealthStats = map[string]*mirrorHealth{}
+
+// Returns the online mirrors in the order they should be tried: the Infinity server followed by
+// externalFilePaths, with any mirror in its cooldown moved to the end so it's only tried once the
+// others have failed
+func onlineMirrors(settings *ServerSettings) []string {
+	mirrors := []string{}
+	seen := map[string]bool{}
+	for _, mirror := range append([]string{settings.InfinityServerURL}, settings.ExternalFilePaths...) {
+		mirror = strings.TrimRight(mirror, "/")
+		if mirror == "" || seen[mirror] {
+			continue
+		}
+		seen[mirror] = true
+		mirrors = append(mirrors, mirror)
+	}
+
+	mirrorHealthMutex.Lock()
+	defer mirrorHealthMutex.Unlock()
+	now := time.Now()
+	sort.SliceStable(mirrors, func(i, j int) bool {
+		return !isMirrorDemoted(mirrors[i], now) && isMirrorDemoted(mirrors[j], now)
+	})
+	return mirrors
+}
+
+// Must be called with mirrorHealthMutex held
+func isMirrorDemoted(mirror string, now time.Time) bool {
+	health, ok := mirrorHealthStats[mirror]
+	return ok && now.Before(health.DemotedUntil)
+}
+
+// Moves a mirror that failed to respond to the back of the list for mirrorCooldown
+func demoteMirror(mirror string, err error) {
+	mirrorHealthMutex.Lock()
+	defer mirrorHealthMutex.Unlock()
+	health, ok := mirrorHealthStats[mirror]
+	if !ok {
+		health = &mirrorHealth{}
+		mirrorHealthStats[mirror] = health
+	}
+	health.Failures++
+	health.LastError = err.Error()
+	health.DemotedUntil = time.Now().Add(mirrorCooldown)
+	fmt.Printf("[Mirrors] %s failed, demoting for %s: %s\n", mirror, mirrorCooldown, err)
+}
+
+// Returns a copy of the health of every mirror that has failed
+func mirrorHealthReport() map[string]mirrorHealth {
+	mirrorHealthMutex.Lock()
+	defer mirrorHealthMutex.Unlock()
+	report := map[string]mirrorHealth{}
+	for mirror, health := range mirrorHealthStats {
+		report[mirror] = *health
+	}
+	return report
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/FlashpointProject/zipfs"
+)
+
+/** Proxy auto-config
+ * <apiPrefix>proxy.pac serves a PAC script, so browsers and plugin containers can be pointed at a
+ * single URL instead of having the proxy set by hand. Hosts with content in a mounted GameZIP or in
+ * htdocs, or set up in hostAliases, sitelocks or websockets, go through the proxy and everything
+ * else goes direct. Host directories such as example.com_8080 and _.example.com are read as
+ * example.com and *.example.com. With pacProxyAll on, or ?all=true, everything but the local
+ * machine goes through the proxy, which online sources such as Infinity and MAD4FP need to see
+ * hosts that haven't been downloaded yet.
+ */
+
+var pacTemplate = template.Must(template.New("pac").Parse(`// Flashpoint proxy auto-config, generated {{.Generated}}
+var proxy = "PROXY {{.Proxy}}";
+var proxyAll = {{.ProxyAll}};
+var hosts = {{.Hosts}};
+var domains = {{.Domains}};
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (host == "localhost" || host == "127.0.0.1" || host == "::1") {
+		return "DIRECT";
+	}
+	if (proxyAll || hosts.hasOwnProperty(host)) {
+		return proxy;
+	}
+	for (var i = 0; i < domains.length; i++) {
+		if (dnsDomainIs(host, domains[i])) {
+			return proxy;
+		}
+	}
+	return "DIRECT";
+}
+`))
+
+// Hosts with content in a zip, cached by path until the zip changes
+type zipHostsCacheEntry struct {
+	modTime time.Time
+	size    int64
+	hosts   []string
+}
+
+var zipHostsCacheMutex sync.Mutex
+var zipHostsCache = map[string]zipHostsCacheEntry{}
+
+// Serves the PAC script
+func servePacApi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET request expected.", http.StatusMethodNotAllowed)
+		return
+	}
+	settings := currentSettings()
+	hosts, domains := pacHosts(settings)
+	hostsObject := map[string]bool{}
+	for _, host := range hosts {
+		hostsObject[host] = true
+	}
+	hostsJSON, _ := json.Marshal(hostsObject)
+	domainsJSON, _ := json.Marshal(domains)
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	err := pacTemplate.Execute(w, map[string]interface{}{
+		"Generated": time.Now().UTC().Format(time.RFC3339),
+		"Proxy":     "127.0.0.1:" + settings.ProxyPort,
+		"ProxyAll":  settings.PacProxyAll || r.URL.Query().Get("all") == "true",
+		"Hosts":     string(hostsJSON),
+		"Domains":   string(domainsJSON),
+	})
+	if err != nil {
+		fmt.Printf("[PAC] Error writing PAC script: %s\n", err)
+	}
+}
+
+// Returns the names of the directories in a directory, none if it can't be read
+func subdirectoryNames(dir string) []string {
+	names := []string{}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// Returns the hosts that should go through the proxy, and the domains whose subdomains should
+func pacHosts(settings *ServerSettings) ([]string, []string) {
+	hostSet := map[string]bool{}
+	domainSet := map[string]bool{}
+	add := func(name string) {
+		name = strings.ToLower(name)
+		// Directories for a single port
+		if i := strings.LastIndex(name, "_"); i > 0 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				name = name[:i]
+			}
+		}
+		if strings.HasPrefix(name, "*.") || strings.HasPrefix(name, "_.") {
+			domainSet[name[1:]] = true
+		} else if name != "" && !strings.ContainsAny(name, "* ") {
+			hostSet[name] = true
+		}
+	}
+
+	for _, zipPath := range mountedZips(settings) {
+		for _, host := range zipContentHosts(zipPath) {
+			add(host)
+		}
+	}
+	if settings.HandleLegacyRequests {
+		// MAD4FP's cache and the override paths hold host directories of their own
+		containers := map[string]bool{"content": true}
+		for _, override := range settings.LegacyOverridePaths {
+			containers[strings.ToLower(path.Clean(override))] = true
+		}
+		for container := range containers {
+			for _, name := range subdirectoryNames(path.Join(settings.LegacyHTDOCSPath, container)) {
+				add(name)
+			}
+		}
+		for _, name := range subdirectoryNames(settings.LegacyHTDOCSPath) {
+			if !containers[strings.ToLower(name)] {
+				add(name)
+			}
+		}
+	}
+	for pattern := range settings.HostAliases {
+		add(pattern)
+	}
+	for pattern := range settings.Sitelocks {
+		add(pattern)
+	}
+	for pattern := range settings.Websockets {
+		add(pattern)
+	}
+
+	hosts := []string{}
+	for host := range hostSet {
+		hosts = append(hosts, host)
+	}
+	domains := []string{}
+	for domain := range domainSet {
+		domains = append(domains, domain)
+	}
+	sort.Strings(hosts)
+	sort.Strings(domains)
+	return hosts, domains
+}
+
+// Returns the paths of the mounted GameZIPs
+func mountedZips(settings *ServerSettings) []string {
+	r, _ := http.NewRequest("GET", "http://127.0.0.1"+path.Join("/", settings.ApiPrefix, "listmountzip"), nil)
+	resp := serveInProcess(zipServer, r)
+	defer resp.Body.Close()
+	mounts := zipfs.MountList{}
+	err := json.NewDecoder(resp.Body).Decode(&mounts)
+	if err != nil {
+		fmt.Printf("[PAC] Error listing mounted zips: %s\n", err)
+	}
+	return mounts.MountedZips
+}
+
+// Returns the hosts a GameZIP has content for
+func zipContentHosts(zipPath string) []string {
+	stats, err := os.Stat(zipPath)
+	if err != nil {
+		return nil
+	}
+	zipHostsCacheMutex.Lock()
+	defer zipHostsCacheMutex.Unlock()
+	if cached, ok := zipHostsCache[zipPath]; ok && cached.modTime.Equal(stats.ModTime()) && cached.size == stats.Size() {
+		return cached.hosts
+	}
+
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		fmt.Printf("[PAC] Error reading %s: %s\n", zipPath, err)
+		return nil
+	}
+	defer reader.Close()
+	seen := map[string]bool{}
+	hosts := []string{}
+	for _, file := range reader.File {
+		parts := strings.SplitN(file.Name, "/", 3)
+		if len(parts) < 3 || parts[0] != "content" || parts[1] == "" || seen[parts[1]] {
+			continue
+		}
+		seen[parts[1]] = true
+		hosts = append(hosts, parts[1])
+	}
+	zipHostsCache[zipPath] = zipHostsCacheEntry{modTime: stats.ModTime(), size: stats.Size(), hosts: hosts}
+	return hosts
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Writes a file to the test htdocs
+func writeTestLegacyFile(t *testing.T, settings *ServerSettings, name string, data string) {
+	filePath := path.Join(settings.LegacyHTDOCSPath, name)
+	err := os.MkdirAll(path.Dir(filePath), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filePath, []byte(data), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPacApi(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = false
+	settings.ApiPrefix = "fpProxy/api/"
+	settings.ProxyPort = "22500"
+	settings.HostAliases = map[string]string{"*.cdn.example.com": "example.com"}
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com_8080/game.swf": "swf",
+		"content/_.games.com/game.swf":      "swf",
+		"content/zip.example.com/game.swf":  "swf",
+	})
+	handler := newApiHandler("fpProxy/api/", http.NotFoundHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://127.0.0.1/fpProxy/api/proxy.pac", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+	pac := w.Body.String()
+	for _, expected := range []string{
+		`var proxy = "PROXY 127.0.0.1:22500";`,
+		`var proxyAll = false;`,
+		`var hosts = {"example.com":true,"zip.example.com":true};`,
+		`var domains = [".cdn.example.com",".games.com"];`,
+	} {
+		if !strings.Contains(pac, expected) {
+			t.Errorf("expected PAC script to contain %s, got\n%s", expected, pac)
+		}
+	}
+
+	// Hosts saved by MAD4FP or kept in an override path are listed, not the directories holding them
+	settings.HandleLegacyRequests = true
+	settings.LegacyHTDOCSPath = t.TempDir()
+	settings.LegacyOverridePaths = []string{"override"}
+	storeSettings(&settings)
+	for _, dir := range []string{"htdocs.example.com", "content/mad4fp.example.com", "override/override.example.com"} {
+		writeTestLegacyFile(t, &settings, dir+"/game.swf", "swf")
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://127.0.0.1/fpProxy/api/proxy.pac", nil))
+	expected := `var hosts = {"example.com":true,"htdocs.example.com":true,"mad4fp.example.com":true,"override.example.com":true,"zip.example.com":true};`
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("expected PAC script to contain %s, got\n%s", expected, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://127.0.0.1/fpProxy/api/proxy.pac?all=true", nil))
+	if !strings.Contains(w.Body.String(), `var proxyAll = true;`) {
+		t.Errorf("expected proxy all mode, got\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Header reporting whether a policy file came from the archive or was synthesized
+const policyHeader = "X-Fpproxy-Policy"
+
+// Flash's cross-domain policy, allowing access from anywhere
+const crossDomainPolicy = `<?xml version="1.0"?>
+<!DOCTYPE cross-domain-policy SYSTEM "http://www.adobe.com/xml/dtds/cross-domain-policy.dtd">
+<cross-domain-policy>
+  <site-control permitted-cross-domain-policies="all"/>
+  <allow-access-from domain="*" secure="false"/>
+  <allow-http-request-headers-from domain="*" headers="*" secure="false"/>
+</cross-domain-policy>
+`
+
+// Silverlight's client access policy, allowing access from anywhere
+const clientAccessPolicy = `<?xml version="1.0" encoding="utf-8"?>
+<access-policy>
+  <cross-domain-access>
+    <policy>
+      <allow-from http-request-headers="*">
+        <domain uri="*"/>
+        <domain uri="http://*"/>
+      </allow-from>
+      <grant-to>
+        <resource path="/" include-subpaths="true"/>
+      </grant-to>
+    </policy>
+  </cross-domain-access>
+</access-policy>
+`
+
+// Returns the synthesized policy and its content type for a policy file request, or "" if the
+// request isn't for a policy file
+func policyFileFor(r *http.Request) (string, string) {
+	switch strings.ToLower(path.Base(r.URL.Path)) {
+	case "crossdomain.xml":
+		return crossDomainPolicy, "text/x-cross-domain-policy"
+	case "clientaccesspolicy.xml":
+		return clientAccessPolicy, "text/xml"
+	}
+	return "", ""
+}
+
+// Answers policy file requests that no source had with a permissive policy when allowCrossDomain
+// is on, so games can still load from other domains when the original policy was never archived
+func servePolicyFile(settings *ServerSettings, r *http.Request, resp *http.Response) *http.Response {
+	policy, contentType := policyFileFor(r)
+	if policy == "" {
+		return resp
+	}
+	if resp.StatusCode < 400 {
+		resp.Header.Set(policyHeader, "archived")
+		return resp
+	}
+	if !settings.AllowCrossDomain {
+		return resp
+	}
+
+	fmt.Printf("[Policy] Serving synthesized policy for %s\n", r.URL)
+	resp.Body.Close()
+	policyResp := serveInProcess(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(policy)))
+		w.Header().Set(policyHeader, "synthesized")
+		w.Write([]byte(policy))
+	}), r)
+	return policyResp
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPolicyFileSynthesized(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.AllowCrossDomain = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{})
+
+	for _, policyPath := range []string{"/crossdomain.xml", "/clientaccesspolicy.xml"} {
+		_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com"+policyPath, nil), nil)
+		body := readTestResponse(t, resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status code 200, got %d", policyPath, resp.StatusCode)
+		}
+		if resp.Header.Get(policyHeader) != "synthesized" {
+			t.Errorf("%s: expected synthesized policy header, got %q", policyPath, resp.Header.Get(policyHeader))
+		}
+		if !bytes.Contains(body, []byte(`"*"`)) {
+			t.Errorf("%s: expected a permissive policy, got %s", policyPath, body)
+		}
+	}
+}
+
+func TestPolicyFileArchived(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.AllowCrossDomain = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/crossdomain.xml": "archived policy",
+	})
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/crossdomain.xml", nil), nil)
+	body := readTestResponse(t, resp)
+	if string(body) != "archived policy" {
+		t.Errorf("expected archived policy, got %s", body)
+	}
+	if resp.Header.Get(policyHeader) != "archived" {
+		t.Errorf("expected archived policy header, got %q", resp.Header.Get(policyHeader))
+	}
+}
+
+func TestPolicyFileDisallowed(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.AllowCrossDomain = false
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{})
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/crossdomain.xml", nil), nil)
+	readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status code 404, got %d", resp.StatusCode)
+	}
+}
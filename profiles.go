@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync/atomic"
+
+	"github.com/FlashpointProject/zipfs"
+)
+
+/** Profiles
+ * A profile is a set of settings layered over the base settings while a game is running, so a
+ * curation can turn on MAD4FP or add override paths without touching anyone else's settings.
+ * Profiles are declared under "profiles" in the settings files, and activated by name through the
+ * api. When applied:
+ * - Lists are appended to the base list
+ * - Maps are merged key by key
+ * - Everything else replaces the base value
+ * Settings that need a restart can't be set by a profile, and neither can the paths of htdocs, the
+ * zips or PHP, so activating a profile can never run or serve anything outside the install.
+ */
+
+// The profile currently in use, nil when none is active
+var activeProfileValue atomic.Value
+
+type settingsProfile struct {
+	Name string `json:"name"`
+}
+
+type profileResponse struct {
+	Active   string   `json:"active"`
+	Profiles []string `json:"profiles"`
+}
+
+func activeProfile() *settingsProfile {
+	profile, _ := activeProfileValue.Load().(*settingsProfile)
+	return profile
+}
+
+// Applies the active profile to the base settings. If it can't be applied it's deactivated and
+// the base settings are used instead.
+func applyActiveProfile(base *ServerSettings) *ServerSettings {
+	profile := activeProfile()
+	if profile == nil || base == nil {
+		return base
+	}
+	settings, err := profileSettings(base, profile)
+	if err != nil {
+		fmt.Printf("[Profiles] Failed to apply profile %s, deactivating: %s\n", profile.Name, err)
+		activeProfileValue.Store((*settingsProfile)(nil))
+		return base
+	}
+	return settings
+}
+
+// Returns the base settings with a profile applied
+func profileSettings(base *ServerSettings, profile *settingsProfile) (*ServerSettings, error) {
+	values, ok := base.Profiles[profile.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %s", profile.Name)
+	}
+	problems := validateProfile("profiles."+profile.Name, values)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	baseLayer, err := structLayer("base", base)
+	if err != nil {
+		return nil, err
+	}
+	profileLayer := &settingsLayer{name: "profile", values: map[string]json.RawMessage{}}
+	for key, value := range values {
+		field, _ := settingStructField(key)
+		if field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.String {
+			value, err = appendStringLists(baseLayer.values[key], value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		profileLayer.values[key] = value
+	}
+	settings, _, err := mergeSettingsLayers([]*settingsLayer{baseLayer, profileLayer})
+	if err != nil {
+		return nil, err
+	}
+	err = resolveSettingsPaths(settings)
+	if err != nil {
+		return nil, err
+	}
+	problems = validateSettings(settings)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return settings, nil
+}
+
+// Appends the overlay list to the base list, skipping values already present
+func appendStringLists(base json.RawMessage, overlay json.RawMessage) (json.RawMessage, error) {
+	baseValues := []string{}
+	overlayValues := []string{}
+	if len(base) > 0 && string(base) != "null" {
+		err := json.Unmarshal(base, &baseValues)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := json.Unmarshal(overlay, &overlayValues)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range overlayValues {
+		found := false
+		for _, existing := range baseValues {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			baseValues = append(baseValues, value)
+		}
+	}
+	return json.Marshal(baseValues)
+}
+
+// Settings a profile can't set, as they say which programs are run and which directories served
+var profileBlockedSettings = map[string]bool{
+	"profiles":         true,
+	"rootPath":         true,
+	"gameDataPath":     true,
+	"phpCgiPath":       true,
+	"legacyPHPPath":    true,
+	"legacyCGIBINPath": true,
+	"legacyHTDOCSPath": true,
+}
+
+// Checks a profile only sets known settings that can change without a restart
+func validateProfile(source string, values map[string]json.RawMessage) SettingsErrors {
+	layer := &settingsLayer{name: source, values: map[string]json.RawMessage{}}
+	for key, value := range values {
+		layer.values[key] = value
+	}
+	problems := validateSettingsLayers([]*settingsLayer{layer})
+	keys := []string{}
+	for key := range layer.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if profileBlockedSettings[key] || isRestartRequired(key) {
+			problems = append(problems, SettingError{Key: key, Source: source, Message: "cannot be set by a profile"})
+		}
+	}
+	return problems
+}
+
+// Checks every profile declared in the settings
+func validateProfiles(settings *ServerSettings) SettingsErrors {
+	problems := SettingsErrors{}
+	names := []string{}
+	for name := range settings.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, validateProfile("profiles."+name, settings.Profiles[name])...)
+	}
+	return problems
+}
+
+// Activates a profile, or deactivates the current one when profile is nil
+func activateProfile(profile *settingsProfile) error {
+	settingsReloadMutex.Lock()
+	defer settingsReloadMutex.Unlock()
+
+	base := baseSettings()
+	settings := base
+	if profile != nil {
+		var err error
+		settings, err = profileSettings(base, profile)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[Profiles] Activated profile %s\n", profile.Name)
+	} else {
+		fmt.Printf("[Profiles] Deactivated profile\n")
+	}
+	activeProfileValue.Store(profile)
+	settingsValue.Store(settings)
+	applySettings(settings)
+	return nil
+}
+
+// GET lists the profiles and which one is active. POST activates the profile named in the body.
+// DELETE, or POST with no name, deactivates the profile.
+func serveProfileApi(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		response := profileResponse{Profiles: []string{}}
+		for name := range baseSettings().Profiles {
+			response.Profiles = append(response.Profiles, name)
+		}
+		sort.Strings(response.Profiles)
+		if profile := activeProfile(); profile != nil {
+			response.Active = profile.Name
+		}
+		writeJsonResponse(w, response, http.StatusOK)
+	case "POST", "DELETE":
+		if !checkApiRequest(w, r) {
+			return
+		}
+		var profile *settingsProfile
+		if r.Method == "POST" {
+			profile = &settingsProfile{}
+			decoder := json.NewDecoder(r.Body)
+			// Only profiles from the settings files can be activated, settings can't be given inline
+			decoder.DisallowUnknownFields()
+			err := decoder.Decode(profile)
+			if err != nil {
+				fmt.Printf("Error (Profile API): %s\n", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if profile.Name == "" {
+				profile = nil
+			}
+		}
+		err := activateProfile(profile)
+		if err != nil {
+			fmt.Printf("Error (Profile API): %s\n", err)
+			writeJsonResponse(w, zipfs.SimpleResponseData{Message: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if profile == nil {
+			writeJsonResponse(w, zipfs.SimpleResponseData{Message: "Profile deactivated!"}, http.StatusOK)
+		} else {
+			writeJsonResponse(w, zipfs.SimpleResponseData{Message: "Profile activated!"}, http.StatusOK)
+		}
+	default:
+		http.Error(w, "GET, POST or DELETE request expected.", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func setupTestProfiles(t *testing.T) http.Handler {
+	setupTestInstall(t)
+	writeTestSettingsFile(t, `{
+		"rootPath": "`+jsonEscape(cwd)+`",
+		"legacyOverridePaths": ["base"],
+		"extMimeTypes": {"swf": "application/x-shockwave-flash"},
+		"profiles": {
+			"mad4fp": {"useMad4FP": true, "legacyOverridePaths": ["extra", "base"], "extMimeTypes": {"dcr": "application/x-director"}},
+			"ports": {"proxyPort": "1234"}
+		}
+	}`)
+	settings, _, err := loadServerSettings()
+	if err == nil {
+		t.Fatal("expected a profile setting proxyPort to be invalid")
+	}
+	writeTestSettingsFile(t, `{
+		"rootPath": "`+jsonEscape(cwd)+`",
+		"legacyOverridePaths": ["base"],
+		"extMimeTypes": {"swf": "application/x-shockwave-flash"},
+		"profiles": {
+			"mad4fp": {"useMad4FP": true, "legacyOverridePaths": ["extra", "base"], "extMimeTypes": {"dcr": "application/x-director"}}
+		}
+	}`)
+	settings, _, err = loadServerSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeProfileValue.Store((*settingsProfile)(nil))
+	storeSettings(settings)
+	t.Cleanup(func() { activeProfileValue.Store((*settingsProfile)(nil)) })
+	return newApiHandler("fpProxy/api/", http.NotFoundHandler())
+}
+
+func TestActivateProfile(t *testing.T) {
+	handler := setupTestProfiles(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, makeJsonRequest("POST", "http://127.0.0.1/fpProxy/api/profile", bytes.NewBufferString(`{"name": "mad4fp"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	settings := currentSettings()
+	if !settings.UseMad4FP {
+		t.Error("expected useMad4FP from the profile")
+	}
+	if len(settings.LegacyOverridePaths) != 2 || settings.LegacyOverridePaths[0] != "base" || settings.LegacyOverridePaths[1] != "extra" {
+		t.Errorf("expected profile override paths to be appended, got %v", settings.LegacyOverridePaths)
+	}
+	if settings.ExtMimeTypes["swf"] == "" || settings.ExtMimeTypes["dcr"] == "" {
+		t.Errorf("expected profile mime types to be merged, got %v", settings.ExtMimeTypes)
+	}
+	if baseSettings().UseMad4FP {
+		t.Error("expected base settings to be left unchanged")
+	}
+
+	// Reloading keeps the profile applied
+	err := reloadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !currentSettings().UseMad4FP {
+		t.Error("expected profile to stay active after a reload")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, makeNewRequest("DELETE", "http://127.0.0.1/fpProxy/api/profile", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", w.Code)
+	}
+	if currentSettings().UseMad4FP {
+		t.Error("expected profile to be deactivated")
+	}
+}
+
+func TestProfileApiRefusals(t *testing.T) {
+	handler := setupTestProfiles(t)
+
+	w := httptest.NewRecorder()
+	body := bytes.NewBufferString(`{"name": "game-1234", "settings": {"useInfinityServer": true}}`)
+	handler.ServeHTTP(w, makeJsonRequest("POST", "http://127.0.0.1/fpProxy/api/profile", body))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code 400 for inline settings, got %d", w.Code)
+	}
+
+	r := makeJsonRequest("POST", "http://127.0.0.1/fpProxy/api/profile", bytes.NewBufferString(`{"name": "mad4fp"}`))
+	r.Header.Set("Origin", "http://attacker.example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status code 403 for a foreign origin, got %d", w.Code)
+	}
+
+	r = makeNewRequest("POST", "http://127.0.0.1/fpProxy/api/profile", bytes.NewBufferString(`{"name": "mad4fp"}`))
+	r.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status code 415 for a body that isn't json, got %d", w.Code)
+	}
+	if activeProfile() != nil {
+		t.Error("expected refused requests to leave the profile inactive")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, makeJsonRequest("POST", "http://127.0.0.1/fpProxy/api/profile", bytes.NewBufferString(`{"name": "missing"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code 400 for an unknown profile, got %d", w.Code)
+	}
+}
+
+func TestProfileBlockedSettings(t *testing.T) {
+	for _, key := range []string{"phpCgiPath", "legacyHTDOCSPath", "gameDataPath", "rootPath"} {
+		problems := validateProfile("profiles.test", map[string]json.RawMessage{key: json.RawMessage(`"/tmp/other"`)})
+		if len(problems) != 1 || problems[0].Key != key {
+			t.Errorf("%s: expected to be refused, got %v", key, problems)
+		}
+	}
+}
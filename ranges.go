@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/** Ranges and conditional requests
+ * Local legacy files are served with http.ServeContent and zipfs answers ranges for zip entries
+ * itself, both with strong ETags. Responses from anywhere else, such as files streamed from
+ * Infinity while they're cached, come back as a full 200, so handleRequest answers for them from
+ * the response's own headers:
+ * - If-None-Match, or If-Modified-Since without it, gives a 304 when the ETag or Last-Modified match
+ * - a single byte range gives a 206 when the length is known, skipping the start of the body.
+ *   If-Range is honoured, and several ranges are answered with the whole body.
+ * - a range starting past the end gives a 416
+ */
+
+// Returns a strong ETag for a local file, from its size and modified time
+func fileETag(stats os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, stats.Size(), stats.ModTime().UnixNano())
+}
+
+// Answers ranges and conditions for a full response, returning the response to send instead
+func applyRangeRequest(r *http.Request, resp *http.Response) *http.Response {
+	if (r.Method != "GET" && r.Method != "HEAD") || resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	// Ranges are of the body as sent, which isn't known ahead of time when it's encoded on the fly
+	rangeable := resp.ContentLength >= 0 && resp.Header.Get("Content-Encoding") == ""
+	if rangeable {
+		resp.Header.Set("Accept-Ranges", "bytes")
+	}
+
+	if isNotModified(r, resp.Header) {
+		resp.Body.Close()
+		header := resp.Header.Clone()
+		header.Del("Content-Length")
+		header.Del("Content-Type")
+		return newEmptyResponse(resp, http.StatusNotModified, header)
+	}
+
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" || !rangeable {
+		return resp
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, resp.Header) {
+		return resp
+	}
+	start, end, ok := parseByteRange(rangeHeader, resp.ContentLength)
+	if !ok {
+		return resp
+	}
+	if start < 0 {
+		resp.Body.Close()
+		header := resp.Header.Clone()
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", resp.ContentLength))
+		header.Set("Content-Length", "0")
+		return newEmptyResponse(resp, http.StatusRequestedRangeNotSatisfiable, header)
+	}
+
+	length := end - start + 1
+	if r.Method != "HEAD" {
+		// An error here shows up again when the rest of the body is read
+		io.CopyN(io.Discard, resp.Body, start)
+	}
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, resp.ContentLength))
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp.StatusCode = http.StatusPartialContent
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.ContentLength = length
+	resp.Body = &readCloser{Reader: io.LimitReader(resp.Body, length), Closer: resp.Body}
+	return resp
+}
+
+// Returns a bodiless response in place of another
+func newEmptyResponse(resp *http.Response, statusCode int, header http.Header) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Request:       resp.Request,
+	}
+}
+
+// Returns whether the client's cached copy is still current
+func isNotModified(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		// If-Modified-Since is ignored when If-None-Match is sent
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ifModifiedSince)
+}
+
+// Returns whether an If-Range validator matches the response, ETags must match strongly
+func ifRangeMatches(ifRange string, header http.Header) bool {
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == header.Get("ETag")
+	}
+	return ifRange == header.Get("Last-Modified")
+}
+
+// Parses a single byte range against a body of size bytes. ok is false if the range should be
+// ignored, and start is -1 if it can't be satisfied.
+func parseByteRange(rangeHeader string, size int64) (start int64, end int64, ok bool) {
+	spec := strings.TrimSpace(rangeHeader)
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(strings.TrimPrefix(spec, "bytes=")), "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		// The last n bytes
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, false
+		}
+		if suffix == 0 || size == 0 {
+			return -1, 0, true
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return -1, 0, true
+	}
+	return start, end, true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-4", 0, 4, true},
+		{"bytes=5-", 5, 9, true},
+		{"bytes=-3", 7, 9, true},
+		{"bytes=-30", 0, 9, true},
+		{"bytes=2-100", 2, 9, true},
+		{"bytes=10-", -1, 0, true},
+		{"bytes=-0", -1, 0, true},
+		{"bytes=0-1,4-5", 0, 0, false},
+		{"bytes=5-2", 0, 0, false},
+		{"items=0-4", 0, 0, false},
+		{"bytes=abc", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, end, ok := parseByteRange(test.header, 10)
+		if ok != test.ok || (ok && (start != test.start || (start >= 0 && end != test.end))) {
+			t.Errorf("%s: expected %d-%d %v, got %d-%d %v", test.header, test.start, test.end, test.ok, start, end, ok)
+		}
+	}
+}
+
+func TestRangeLegacyFile(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{})
+	writeTestLegacyFile(t, &settings, "example.com/test.txt", "0123456789")
+
+	r := httptest.NewRequest("GET", "http://example.com/test.txt", nil)
+	r.Header.Set("Range", "bytes=2-5")
+	_, resp := handleRequest(r, nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "2345" {
+		t.Fatalf("expected 206 2345, got %d %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("expected Content-Range bytes 2-5/10, got %s", resp.Header.Get("Content-Range"))
+	}
+	etag := resp.Header.Get("ETag")
+	if len(etag) < 3 || etag[0] != '"' {
+		t.Fatalf("expected a strong ETag, got %s", etag)
+	}
+
+	r = httptest.NewRequest("GET", "http://example.com/test.txt", nil)
+	r.Header.Set("If-None-Match", etag)
+	_, resp = handleRequest(r, nil)
+	body = readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("expected 304 for a matching ETag, got %d %s", resp.StatusCode, body)
+	}
+
+	r = httptest.NewRequest("GET", "http://example.com/test.txt", nil)
+	r.Header.Set("Range", "bytes=20-")
+	_, resp = handleRequest(r, nil)
+	readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */10" {
+		t.Errorf("expected 416 with bytes */10, got %d %s", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+}
+
+func TestRangeStreamedInfinityFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/example.com/game.swf" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.UseInfinityServer = true
+	settings.InfinityServerURL = server.URL
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{})
+
+	r := httptest.NewRequest("GET", "http://example.com/game.swf", nil)
+	r.Header.Set("Range", "bytes=-4")
+	_, resp := handleRequest(r, nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "6789" {
+		t.Fatalf("expected 206 6789, got %d %s", resp.StatusCode, body)
+	}
+	// The whole file is still cached
+	saved, err := os.ReadFile(path.Join(settings.LegacyHTDOCSPath, "example.com", "game.swf"))
+	if err != nil || string(saved) != "0123456789" {
+		t.Errorf("expected the whole file to be saved, got %s %v", saved, err)
+	}
+
+	// Served from the cache now, with a stale If-Range getting the whole file
+	r = httptest.NewRequest("GET", "http://example.com/game.swf", nil)
+	r.Header.Set("Range", "bytes=0-1")
+	r.Header.Set("If-Range", `"stale"`)
+	_, resp = handleRequest(r, nil)
+	body = readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK || string(body) != "0123456789" {
+		t.Errorf("expected 200 with the whole file for a stale If-Range, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestRangeStreamedResponse(t *testing.T) {
+	resp := serveInProcess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write([]byte("0123456789"))
+	}), httptest.NewRequest("GET", "http://example.com/", nil))
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	notModified := applyRangeRequest(r, resp)
+	if notModified.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 for an unchanged Last-Modified, got %d", notModified.StatusCode)
+	}
+}
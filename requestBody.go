@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Request bodies up to this size are kept in memory, larger ones are spilled to a temporary file
+const requestBodyMemoryLimit = 1 << 20
+
+// A request body that can be read any number of times, so it can be replayed to each content source
+type replayableBody struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// Reads the whole body, keeping it in memory if small enough or spilling it to disk otherwise
+func newReplayableBody(body io.Reader) (*replayableBody, error) {
+	if body == nil || body == http.NoBody {
+		return &replayableBody{}, nil
+	}
+	buf := &bytes.Buffer{}
+	size, err := io.CopyN(buf, body, requestBodyMemoryLimit+1)
+	if err == io.EOF {
+		return &replayableBody{data: buf.Bytes(), size: size}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Too large to keep in memory
+	file, err := os.CreateTemp("", "fp-body-")
+	if err != nil {
+		return nil, err
+	}
+	replay := &replayableBody{file: file}
+	_, err = io.Copy(file, buf)
+	if err == nil {
+		replay.size, err = io.Copy(file, body)
+		replay.size += size
+	}
+	if err != nil {
+		replay.Close()
+		return nil, err
+	}
+	return replay, nil
+}
+
+// Returns a new reader starting from the beginning of the body
+func (b *replayableBody) NewReader() io.ReadCloser {
+	if b.size == 0 {
+		return http.NoBody
+	}
+	if b.file != nil {
+		return io.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+	}
+	return io.NopCloser(bytes.NewReader(b.data))
+}
+
+// Removes the temporary file, if the body was spilled to disk
+func (b *replayableBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// A response body that runs a function once it's closed
+type onCloseBody struct {
+	io.ReadCloser
+	onClose func()
+	closed  bool
+}
+
+func (b *onCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.closed {
+		b.closed = true
+		b.onClose()
+	}
+	return err
+}
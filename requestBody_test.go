@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestReplayableBody(t *testing.T) {
+	small := []byte("data=success")
+	large := bytes.Repeat([]byte("x"), requestBodyMemoryLimit+100)
+
+	for _, data := range [][]byte{small, large} {
+		body, err := newReplayableBody(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (body.file != nil) != (len(data) > requestBodyMemoryLimit) {
+			t.Errorf("expected only bodies over the memory limit to spill to disk, %d bytes", len(data))
+		}
+		if body.size != int64(len(data)) {
+			t.Errorf("expected size %d, got %d", len(data), body.size)
+		}
+		// Read twice to make sure it replays
+		for i := 0; i < 2; i++ {
+			replayed, err := io.ReadAll(body.NewReader())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(replayed, data) {
+				t.Errorf("expected replay %d to match the original body", i)
+			}
+		}
+		err = body.Close()
+		if err != nil {
+			t.Error(err)
+		}
+		if body.file != nil {
+			_, err = os.Stat(body.file.Name())
+			if !os.IsNotExist(err) {
+				t.Error("expected spilled body to be removed")
+			}
+		}
+	}
+}
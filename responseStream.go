@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// A ResponseWriter that turns whatever a handler writes into an *http.Response,
+// handing the response over as soon as the headers are written and streaming the body after
+type streamResponseWriter struct {
+	header      http.Header
+	body        *io.PipeWriter
+	resp        *http.Response
+	ready       chan struct{}
+	wroteHeader bool
+}
+
+func (w *streamResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	// Copy the headers, the handler is free to keep changing its own after this
+	w.resp.Header = w.header.Clone()
+	w.resp.StatusCode = statusCode
+	w.resp.Status = fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
+	if length, err := strconv.ParseInt(w.resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		w.resp.ContentLength = length
+	}
+	close(w.ready)
+}
+
+func (w *streamResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(data)
+}
+
+// Data is handed to the reader as it's written, so there's nothing to flush
+func (w *streamResponseWriter) Flush() {}
+
+// Runs a handler in the background and returns its response once the headers are written.
+// The body streams from the handler as it's read, and closing it stops the handler writing.
+func serveInProcess(handler http.Handler, r *http.Request) *http.Response {
+	bodyReader, bodyWriter := io.Pipe()
+	w := &streamResponseWriter{
+		header: http.Header{},
+		body:   bodyWriter,
+		ready:  make(chan struct{}),
+	}
+	w.resp = &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Body:          bodyReader,
+		ContentLength: -1,
+		Request:       r,
+	}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				fmt.Printf("Error serving %s in-process: %v\n", r.URL, err)
+				if !w.wroteHeader {
+					w.header = http.Header{}
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				bodyWriter.CloseWithError(fmt.Errorf("%v", err))
+				return
+			}
+			if !w.wroteHeader {
+				w.WriteHeader(http.StatusOK)
+			}
+			bodyWriter.Close()
+		}()
+		handler.ServeHTTP(w, r)
+	}()
+	<-w.ready
+	return w.resp
+}
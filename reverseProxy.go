@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+/** Reverse proxy
+ * Some projectors and embedded browsers ignore proxy settings, and can only be pointed at the proxy
+ * with a hosts file entry or a loopback IP. They send origin-form requests (GET /game.swf) with the
+ * site in the Host header, which are given the host from it and served like any other request.
+ * This is done on the proxy port, and on reverseProxyPort when it's set, e.g. 80 for hosts file
+ * entries. Requests with no Host, or with the proxy itself as Host, get a 400 as there's nothing
+ * to look up.
+ */
+
+// Serves origin-form requests by their Host header
+func newReverseProxyHandler() http.Handler {
+	return http.AllowQuerySemicolons(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _ := splitHostPort(r.Host)
+		if host == "" || isLocalHost(host) {
+			http.Error(w, "This is a proxy server, requests need a Host header for the site they're for.", http.StatusBadRequest)
+			return
+		}
+		setAbsoluteRequestURL(r, r.Host)
+		if currentSettings().VerboseLogging {
+			fmt.Printf("[Reverse] Serving %s\n", r.URL)
+		}
+		newWebsocketHandler(http.HandlerFunc(serveHandledRequest)).ServeHTTP(w, r)
+	}))
+}
+
+// Gives an origin-form request the absolute URL a proxy request would have, using its Host header
+// or fallbackHost without one
+func setAbsoluteRequestURL(r *http.Request, fallbackHost string) {
+	r.URL.Scheme = "http"
+	if r.TLS != nil {
+		r.URL.Scheme = "https"
+	}
+	r.URL.Host = r.Host
+	if r.URL.Host == "" {
+		r.URL.Host = fallbackHost
+	}
+	r.RequestURI = r.URL.String()
+}
+
+// Answers a request with handleRequest
+func serveHandledRequest(w http.ResponseWriter, r *http.Request) {
+	_, resp := handleRequest(r, nil)
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err := io.Copy(w, resp.Body)
+	if err != nil {
+		fmt.Printf("Error writing response to client: %s\n", err)
+	}
+}
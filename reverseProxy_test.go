@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReverseProxyHostHeader(t *testing.T) {
+	settings := testServerSettings
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/www.example.com/test.txt": "success",
+	})
+	handler := newReverseProxyHandler()
+
+	r := httptest.NewRequest("GET", "/test.txt", nil)
+	r.Host = "www.example.com"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "success" {
+		t.Errorf("expected success, got %d %s", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/test.txt", nil)
+	r.Host = "127.0.0.1:22500"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code 400 for the proxy itself, got %d", w.Code)
+	}
+}
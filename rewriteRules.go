@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+/** Rewrite rules
+ * Small server side fixes for games, read from proxyRewriteRules.json next to the settings files.
+ * The file holds a list of rules, each run in one phase:
+ * - "request" rules run before the content is looked up, and can rewrite or redirect the URL,
+ *   remove query parameters and set or remove request headers
+ * - "response" rules run once the content is found, and can set or remove response headers and
+ *   replace text in the body. Range requests for URLs with replacements get the whole body.
+ * A rule applies when the request's host matches one of "hosts" (exact, or *. for any subdomain,
+ * all hosts when empty) and its path and query match the "match" regex. Rewrites and redirects
+ * can use the regex's groups, e.g.
+ *   {"hosts": ["example.com"], "match": "^/old/(.*)$", "rewrite": "/new/$1"}
+ * Every rule applied is logged when verboseLogging is on.
+ */
+
+const (
+	rewritePhaseRequest  = "request"
+	rewritePhaseResponse = "response"
+)
+
+// Largest body text can be replaced in, anything bigger is passed through untouched
+const rewriteBodyLimit = 16 * 1024 * 1024
+
+// Holds the []*rewriteRule in use
+var rewriteRulesValue atomic.Value
+
+type rewriteRule struct {
+	Name          string               `json:"name"`
+	Phase         string               `json:"phase"`
+	Hosts         []string             `json:"hosts"`
+	Match         string               `json:"match"`
+	Rewrite       string               `json:"rewrite"`
+	Redirect      string               `json:"redirect"`
+	RemoveQuery   []string             `json:"removeQuery"`
+	SetHeaders    map[string]string    `json:"setHeaders"`
+	RemoveHeaders []string             `json:"removeHeaders"`
+	Replace       []rewriteReplacement `json:"replace"`
+	// Content types text is replaced in, defaults to text, html, xml, javascript and json
+	ContentTypes []string `json:"contentTypes"`
+
+	match *regexp.Regexp
+}
+
+// Replaces find with with in a response body, find is a regex when Regex is set
+type rewriteReplacement struct {
+	Find  string `json:"find"`
+	With  string `json:"with"`
+	Regex bool   `json:"regex"`
+
+	find *regexp.Regexp
+}
+
+func rewriteRulesFilePath() string {
+	return filepath.Join(cwd, "proxyRewriteRules.json")
+}
+
+// Returns the rewrite rules in use
+func currentRewriteRules() []*rewriteRule {
+	rules, _ := rewriteRulesValue.Load().([]*rewriteRule)
+	return rules
+}
+
+// Reads and compiles the rules file, a missing file means there are no rules
+func loadRewriteRules(filePath string) ([]*rewriteRule, error) {
+	rules := []*rewriteRule{}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rules, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filePath, err)
+	}
+	problems := SettingsErrors{}
+	for i, rule := range rules {
+		key := fmt.Sprintf("rules[%d]", i)
+		if rule.Name == "" {
+			rule.Name = key
+		}
+		for _, message := range rule.compile() {
+			problems = append(problems, SettingError{Key: key, Source: filepath.Base(filePath), Message: message})
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return rules, nil
+}
+
+// Compiles the rule's regexes, returning every problem with the rule
+func (rule *rewriteRule) compile() []string {
+	problems := []string{}
+	var err error
+	if rule.Phase == "" {
+		rule.Phase = rewritePhaseRequest
+	}
+	if rule.Phase != rewritePhaseRequest && rule.Phase != rewritePhaseResponse {
+		problems = append(problems, fmt.Sprintf("invalid phase %q, must be request or response", rule.Phase))
+	}
+	rule.match, err = regexp.Compile(rule.Match)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("invalid match regex: %s", err))
+	}
+	if rule.Phase == rewritePhaseResponse && (rule.Rewrite != "" || rule.Redirect != "" || len(rule.RemoveQuery) > 0) {
+		problems = append(problems, "rewrite, redirect and removeQuery can only be used in the request phase")
+	}
+	if rule.Phase == rewritePhaseRequest && len(rule.Replace) > 0 {
+		problems = append(problems, "replace can only be used in the response phase")
+	}
+	if rule.Rewrite != "" && rule.Redirect != "" {
+		problems = append(problems, "rewrite and redirect can't both be used")
+	}
+	for i := range rule.Replace {
+		replacement := &rule.Replace[i]
+		if replacement.Find == "" {
+			problems = append(problems, fmt.Sprintf("replace[%d] has nothing to find", i))
+			continue
+		}
+		if replacement.Regex {
+			replacement.find, err = regexp.Compile(replacement.Find)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("invalid replace[%d] regex: %s", i, err))
+			}
+		}
+	}
+	return problems
+}
+
+// Returns whether the rule applies to a request
+func (rule *rewriteRule) matches(u *url.URL) bool {
+	if len(rule.Hosts) > 0 {
+		found := false
+		for _, pattern := range rule.Hosts {
+			if hostMatchesPattern(strings.ToLower(u.Host), strings.ToLower(pattern)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return rule.match.MatchString(u.RequestURI())
+}
+
+func traceRewriteRule(settings *ServerSettings, rule *rewriteRule, format string, args ...interface{}) {
+	if settings.VerboseLogging {
+		fmt.Printf("[Rewrite] %s (%s): %s\n", rule.Name, rule.Phase, fmt.Sprintf(format, args...))
+	}
+}
+
+// Runs the request phase rules, changing the request in place. Returns a response when a rule
+// redirects the request, nil otherwise.
+func applyRequestRules(settings *ServerSettings, rules []*rewriteRule, r *http.Request) *http.Response {
+	for _, rule := range rules {
+		if rule.Phase != rewritePhaseRequest || !rule.matches(r.URL) {
+			continue
+		}
+		if rule.Redirect != "" {
+			location := rule.match.ReplaceAllString(r.URL.RequestURI(), rule.Redirect)
+			traceRewriteRule(settings, rule, "redirecting %s to %s", r.URL, location)
+			resp := serveInProcess(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				http.Redirect(w, req, location, http.StatusFound)
+			}), r)
+			return resp
+		}
+		if rule.Rewrite != "" {
+			target := rule.match.ReplaceAllString(r.URL.RequestURI(), rule.Rewrite)
+			rewritten, err := r.URL.Parse(target)
+			if err != nil {
+				fmt.Printf("[Rewrite] %s: invalid rewrite of %s to %s: %s\n", rule.Name, r.URL, target, err)
+			} else {
+				traceRewriteRule(settings, rule, "rewriting %s to %s", r.URL, rewritten)
+				r.URL = rewritten
+			}
+		}
+		if len(rule.RemoveQuery) > 0 {
+			r.URL.RawQuery = removeQueryParams(r.URL.RawQuery, rule.RemoveQuery)
+			traceRewriteRule(settings, rule, "removed query parameters %s", strings.Join(rule.RemoveQuery, ", "))
+		}
+		for _, name := range rule.RemoveHeaders {
+			r.Header.Del(name)
+			traceRewriteRule(settings, rule, "removed request header %s", name)
+		}
+		for name, value := range rule.SetHeaders {
+			r.Header.Set(name, value)
+			traceRewriteRule(settings, rule, "set request header %s: %s", name, value)
+		}
+	}
+	return nil
+}
+
+// Runs the response phase rules, changing the response in place
+func applyResponseRules(settings *ServerSettings, rules []*rewriteRule, r *http.Request, resp *http.Response) {
+	for _, rule := range rules {
+		if rule.Phase != rewritePhaseResponse || !rule.matches(r.URL) {
+			continue
+		}
+		for _, name := range rule.RemoveHeaders {
+			resp.Header.Del(name)
+			traceRewriteRule(settings, rule, "removed response header %s", name)
+		}
+		for name, value := range rule.SetHeaders {
+			resp.Header.Set(name, value)
+			traceRewriteRule(settings, rule, "set response header %s: %s", name, value)
+		}
+		if len(rule.Replace) > 0 {
+			replaceResponseText(settings, rule, resp)
+		}
+	}
+}
+
+// Drops the Range of a request whose response will have text replaced, so the whole file is
+// fetched rather than a part whose Content-Range wouldn't match the new body
+func ignoreRangeForReplace(rules []*rewriteRule, r *http.Request) {
+	if r.Header.Get("Range") == "" {
+		return
+	}
+	for _, rule := range rules {
+		if rule.Phase == rewritePhaseResponse && len(rule.Replace) > 0 && rule.matches(r.URL) {
+			r.Header.Del("Range")
+			r.Header.Del("If-Range")
+			return
+		}
+	}
+}
+
+// Replaces text in the response body, skipping bodies that aren't whole, aren't text or are too
+// big to hold
+func replaceResponseText(settings *ServerSettings, rule *rewriteRule, resp *http.Response) {
+	if resp.StatusCode != http.StatusOK {
+		traceRewriteRule(settings, rule, "skipped replace, status is %d", resp.StatusCode)
+		return
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		traceRewriteRule(settings, rule, "skipped replace, body is encoded")
+		return
+	}
+	if !rule.isTextType(resp.Header.Get("Content-Type")) {
+		traceRewriteRule(settings, rule, "skipped replace, %q isn't a text type", resp.Header.Get("Content-Type"))
+		return
+	}
+	if resp.ContentLength > rewriteBodyLimit {
+		traceRewriteRule(settings, rule, "skipped replace, body is too large")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, rewriteBodyLimit+1))
+	if err != nil {
+		fmt.Printf("[Rewrite] %s: failed to read body: %s\n", rule.Name, err)
+		resp.Body = &readCloser{Reader: bytes.NewReader(body), Closer: resp.Body}
+		return
+	}
+	if len(body) > rewriteBodyLimit {
+		// Too big after all, put back what was read and stream the rest
+		traceRewriteRule(settings, rule, "skipped replace, body is too large")
+		resp.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return
+	}
+	resp.Body.Close()
+
+	for _, replacement := range rule.Replace {
+		var replaced []byte
+		if replacement.find != nil {
+			replaced = replacement.find.ReplaceAll(body, []byte(replacement.With))
+		} else {
+			replaced = bytes.ReplaceAll(body, []byte(replacement.Find), []byte(replacement.With))
+		}
+		if !bytes.Equal(replaced, body) {
+			traceRewriteRule(settings, rule, "replaced %q with %q", replacement.Find, replacement.With)
+		}
+		body = replaced
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+}
+
+func (rule *rewriteRule) isTextType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if len(rule.ContentTypes) > 0 {
+		for _, allowed := range rule.ContentTypes {
+			if strings.EqualFold(mediaType, allowed) {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "xml") ||
+		strings.HasSuffix(mediaType, "javascript") || strings.HasSuffix(mediaType, "json")
+}
+
+// Pairs a reader with the closer of the body it was built from
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Removes the named parameters from a raw query, leaving the rest exactly as it was sent, since
+// re-encoding could reorder them or change their escaping and so the file they're saved under
+func removeQueryParams(rawQuery string, names []string) string {
+	kept := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		removed := false
+		for _, name := range names {
+			if key == name {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
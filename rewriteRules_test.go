@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Loads rules from json and uses them until the test ends
+func setupTestRewriteRules(t *testing.T, rulesJSON string) {
+	filePath := filepath.Join(t.TempDir(), "proxyRewriteRules.json")
+	err := os.WriteFile(filePath, []byte(rulesJSON), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadRewriteRules(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewriteRulesValue.Store(rules)
+	t.Cleanup(func() { rewriteRulesValue.Store([]*rewriteRule{}) })
+}
+
+func TestLoadRewriteRulesInvalid(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "proxyRewriteRules.json")
+	err := os.WriteFile(filePath, []byte(`[
+		{"phase": "later"},
+		{"match": "(unclosed"},
+		{"replace": [{"find": "a", "with": "b"}]},
+		{"phase": "response", "rewrite": "/new"}
+	]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadRewriteRules(filePath)
+	var problems SettingsErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("expected settings errors, got %v", err)
+	}
+	if len(problems) != 4 {
+		t.Errorf("expected 4 problems, got %s", problems)
+	}
+}
+
+func TestRewriteRulesRewrite(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/new/game.swf": "zipped swf",
+	})
+	setupTestRewriteRules(t, `[
+		{"hosts": ["other.com"], "match": "^/old/(.*)$", "rewrite": "/wrong/$1"},
+		{"hosts": ["*.example.com", "example.com"], "match": "^/old/(.*)$", "rewrite": "/new/$1", "removeQuery": ["cachebuster"]}
+	]`)
+
+	r, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/old/game.swf?cachebuster=123", nil), nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "zipped swf" {
+		t.Errorf("expected rewritten file, got %s", body)
+	}
+	if r.URL.RawQuery != "" {
+		t.Errorf("expected query to be removed, got %s", r.URL.RawQuery)
+	}
+}
+
+func TestRemoveQueryParams(t *testing.T) {
+	tests := []struct {
+		rawQuery string
+		expected string
+	}{
+		{"b=%7E&a=1&cb=123", "b=%7E&a=1"},
+		{"cb=1&z=a+b&cb=2&flag", "z=a+b&flag"},
+		{"c%62=1&x=%2F", "x=%2F"},
+		{"cb", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if result := removeQueryParams(test.rawQuery, []string{"cb"}); result != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.rawQuery, test.expected, result)
+		}
+	}
+}
+
+func TestRewriteRulesRedirect(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{})
+	setupTestRewriteRules(t, `[{"match": "^/game\\.swf$", "redirect": "/games/game.swf"}]`)
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/game.swf", nil), nil)
+	readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected status code 302, got %d", resp.StatusCode)
+	}
+	if location := resp.Header.Get("Location"); location != "/games/game.swf" {
+		t.Errorf("expected redirect to /games/game.swf, got %s", location)
+	}
+}
+
+func TestRewriteRulesResponse(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.ExtMimeTypes = map[string]string{"html": "text/html"}
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/page.html": `<embed src="http://old.example.com/game.swf">`,
+	})
+	setupTestRewriteRules(t, `[{
+		"phase": "response",
+		"hosts": ["example.com"],
+		"setHeaders": {"X-Curation-Fix": "1"},
+		"replace": [{"find": "old\\.(example\\.com)", "with": "$1", "regex": true}]
+	}]`)
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://example.com/page.html", nil), nil)
+	body := readTestResponse(t, resp)
+	if string(body) != `<embed src="http://example.com/game.swf">` {
+		t.Errorf("expected host to be replaced, got %s", body)
+	}
+	if resp.Header.Get("X-Curation-Fix") != "1" {
+		t.Errorf("expected header to be set")
+	}
+}
+
+func TestRewriteRulesReplaceRange(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.ExtMimeTypes = map[string]string{"html": "text/html"}
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/page.html": `<embed src="http://old.example.com/game.swf">`,
+	})
+	setupTestRewriteRules(t, `[{
+		"phase": "response",
+		"hosts": ["example.com"],
+		"replace": [{"find": "old.example.com", "with": "example.com"}]
+	}]`)
+
+	// The range was of the original bytes, so the whole replaced body is sent instead
+	r := httptest.NewRequest("GET", "http://example.com/page.html", nil)
+	r.Header.Set("Range", "bytes=20-")
+	_, resp := handleRequest(r, nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Range") != "" {
+		t.Errorf("expected a whole 200 response, got %d with Content-Range %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	if string(body) != `<embed src="http://example.com/game.swf">` {
+		t.Errorf("expected host to be replaced in the whole body, got %s", body)
+	}
+}
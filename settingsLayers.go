@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/** Settings are built from layers, each later layer overriding the ones before it:
+ * 1. Built-in defaults
+ * 2. proxySettings.json
+ * 3. proxySettings.user.json, for user changes that launcher updates won't overwrite
+ * 4. FPPROXY_* environment variables
+ * 5. Command line flags
+ *
+ * Maps (such as extMimeTypes) are merged key by key, every other setting is replaced whole.
+ */
+
+// Prefix of every environment variable that overrides a setting, e.g. FPPROXY_PROXY_PORT
+const settingsEnvPrefix = "FPPROXY_"
+
+// Maps the json key of each setting to the name of the layer(s) its value came from
+type settingsSources map[string]string
+
+// A single layer of settings, only holding the keys it sets
+type settingsLayer struct {
+	name   string
+	values map[string]json.RawMessage
+}
+
+// Flags that were given explicitly on the command line, in the order they were parsed
+var settingsFlagValues = []*settingFlag{}
+
+// A command line flag that overrides a setting
+type settingFlag struct {
+	key    string
+	isBool bool
+	value  string
+}
+
+func (f *settingFlag) String() string {
+	return f.value
+}
+
+func (f *settingFlag) Set(value string) error {
+	f.value = value
+	settingsFlagValues = append(settingsFlagValues, f)
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// The built-in defaults, used for anything not set by another layer
+func defaultServerSettings() *ServerSettings {
+	return &ServerSettings{
+		RootPath:            "../",
+		GameDataPath:        "Data/Games/",
+		LegacyPHPPath:       "Legacy/",
+		LegacyCGIBINPath:    "Legacy/cgi-bin/",
+		LegacyHTDOCSPath:    "Legacy/htdocs/",
+		PhpCgiPath:          "Legacy/php-cgi.exe",
+		InfinityServerURL:   "https://infinity.flashpointarchive.org/Flashpoint/Legacy/htdocs/",
+		ExternalLegacyPort:  "22600",
+		ProxyPort:           "22500",
+		ServerHTTPPort:      "22501",
+		AllowCrossDomain:    true,
+		SocketPolicyPort:    "843",
+		ApiPrefix:           "fpProxy/api/",
+		OverridePaths:       []string{},
+		LegacyOverridePaths: []string{},
+		ExternalFilePaths:   []string{},
+		ExtScriptTypes:      []string{"php", "php5", "phtml"},
+		ExtIndexTypes:       []string{"html", "htm", "php", "php5", "phtml"},
+		ExtGzippeddTypes:    []string{"svgz"},
+		ExtMimeTypes:        map[string]string{},
+		HostAliases:         map[string]string{},
+		CorsAllowedOrigins:  map[string][]string{},
+		Sitelocks:           map[string]SitelockOptions{},
+		Websockets:          map[string]WebsocketEndpoint{},
+		SocketServers:       map[string]SocketServerOptions{},
+		ContentSources:      []ContentSourceOptions{},
+		CompressMinSize:     1024,
+		CompressMimeTypes: []string{
+			"text/*", "application/javascript", "application/json", "application/xml",
+			"application/xhtml+xml", "image/svg+xml",
+		},
+	}
+}
+
+func userSettingsFilePath() string {
+	return filepath.Join(cwd, "proxySettings.user.json")
+}
+
+// Registers a flag for every setting, plus any aliases kept for older launchers
+func registerSettingsFlags(flags *flag.FlagSet, descriptions map[string]string, aliases map[string]string) {
+	settingsType := reflect.TypeOf(ServerSettings{})
+	for i := 0; i < settingsType.NumField(); i++ {
+		field := settingsType.Field(i)
+		key := settingKey(field)
+		usage := descriptions[key]
+		if usage == "" {
+			usage = "Overrides the " + key + " setting"
+		}
+		flags.Var(&settingFlag{key: key, isBool: field.Type.Kind() == reflect.Bool}, key, usage)
+	}
+	for alias, key := range aliases {
+		field, ok := settingStructField(key)
+		if !ok {
+			continue
+		}
+		flags.Var(&settingFlag{key: key, isBool: field.Type.Kind() == reflect.Bool}, alias, "Alias of -"+key)
+	}
+}
+
+// Builds the settings from every layer, resolves all paths and validates the result, returning where each value came from.
+// When the settings were built but aren't valid, they're returned along with the SettingsErrors, so they can still be shown.
+func loadServerSettings() (*ServerSettings, settingsSources, error) {
+	layers := []*settingsLayer{}
+
+	defaults, err := structLayer("default", defaultServerSettings())
+	if err != nil {
+		return nil, nil, err
+	}
+	layers = append(layers, defaults)
+
+	fileLayer, err := fileSettingsLayer("file", settingsFilePath(), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	layers = append(layers, fileLayer)
+
+	userLayer, err := fileSettingsLayer("user", userSettingsFilePath(), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	layers = append(layers, userLayer)
+
+	envLayer, err := envSettingsLayer(os.Environ())
+	if err != nil {
+		return nil, nil, err
+	}
+	layers = append(layers, envLayer)
+
+	flagLayer, err := flagSettingsLayer(settingsFlagValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	layers = append(layers, flagLayer)
+
+	// Collect every problem before giving up, so they can all be fixed at once
+	problems := validateSettingsLayers(layers)
+	settings, sources, err := mergeSettingsLayers(layers)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = resolveSettingsPaths(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	problems = append(problems, validateSettings(settings)...)
+	if len(problems) > 0 {
+		return settings, sources, problems
+	}
+	return settings, sources, nil
+}
+
+// Creates a layer setting every value of the given settings
+func structLayer(name string, settings *ServerSettings) (*settingsLayer, error) {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	layer := &settingsLayer{name: name}
+	err = json.Unmarshal(data, &layer.values)
+	if err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// Creates a layer from a json settings file. A missing optional file gives an empty layer.
+func fileSettingsLayer(name string, filePath string, required bool) (*settingsLayer, error) {
+	layer := &settingsLayer{name: name, values: map[string]json.RawMessage{}}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if !required && os.IsNotExist(err) {
+			return layer, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &layer.values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filePath, err)
+	}
+	return layer, nil
+}
+
+// Creates a layer from any FPPROXY_* variables in the environment
+func envSettingsLayer(environ []string) (*settingsLayer, error) {
+	layer := &settingsLayer{name: "env", values: map[string]json.RawMessage{}}
+	env := map[string]string{}
+	for _, entry := range environ {
+		name, value, found := strings.Cut(entry, "=")
+		if found && strings.HasPrefix(name, settingsEnvPrefix) {
+			env[name] = value
+		}
+	}
+	settingsType := reflect.TypeOf(ServerSettings{})
+	for i := 0; i < settingsType.NumField(); i++ {
+		field := settingsType.Field(i)
+		key := settingKey(field)
+		value, ok := env[settingEnvName(key)]
+		if !ok {
+			continue
+		}
+		raw, err := settingTextToJSON(field.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", settingEnvName(key), err)
+		}
+		layer.values[key] = raw
+	}
+	return layer, nil
+}
+
+// Creates a layer from the flags given on the command line
+func flagSettingsLayer(flags []*settingFlag) (*settingsLayer, error) {
+	layer := &settingsLayer{name: "flag", values: map[string]json.RawMessage{}}
+	for _, f := range flags {
+		field, _ := settingStructField(f.key)
+		raw, err := settingTextToJSON(field.Type, f.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -%s: %w", f.key, err)
+		}
+		layer.values[f.key] = raw
+	}
+	return layer, nil
+}
+
+// Applies each layer in order, recording which layer each value came from
+func mergeSettingsLayers(layers []*settingsLayer) (*ServerSettings, settingsSources, error) {
+	merged := map[string]json.RawMessage{}
+	sources := settingsSources{}
+	for _, layer := range layers {
+		for key, value := range layer.values {
+			if key == "hostAliases" && string(value) != "null" {
+				lowered, err := lowerHostAliases(value)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid %s in %s settings: %w", key, layer.name, err)
+				}
+				value = lowered
+			}
+			existing, exists := merged[key]
+			field, known := settingStructField(key)
+			if exists && known && field.Type.Kind() == reflect.Map && string(value) != "null" {
+				combined, err := mergeJSONObjects(existing, value)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid %s in %s settings: %w", key, layer.name, err)
+				}
+				merged[key] = combined
+				if sources[key] == "default" {
+					sources[key] = layer.name
+				} else if sources[key] != layer.name {
+					sources[key] = sources[key] + "+" + layer.name
+				}
+				continue
+			}
+			merged[key] = value
+			sources[key] = layer.name
+		}
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+	settings := &ServerSettings{}
+	err = json.Unmarshal(data, settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	return settings, sources, nil
+}
+
+func mergeJSONObjects(base json.RawMessage, overlay json.RawMessage) (json.RawMessage, error) {
+	baseValues := map[string]json.RawMessage{}
+	overlayValues := map[string]json.RawMessage{}
+	if string(base) != "null" {
+		err := json.Unmarshal(base, &baseValues)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := json.Unmarshal(overlay, &overlayValues)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range overlayValues {
+		baseValues[key] = value
+	}
+	return json.Marshal(baseValues)
+}
+
+// Converts the text form of a setting, as given by a flag or environment variable, to json.
+// Lists are comma separated and maps are comma separated key=value pairs, or either can be given as json.
+// Maps whose values aren't text, such as sitelocks, can only be given as json.
+func settingTextToJSON(fieldType reflect.Type, text string) (json.RawMessage, error) {
+	switch fieldType.Kind() {
+	case reflect.String:
+		return json.Marshal(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(b)
+	case reflect.Slice:
+		if strings.HasPrefix(strings.TrimSpace(text), "[") {
+			return validateSettingJSON(fieldType, text)
+		}
+		values := []string{}
+		for _, value := range strings.Split(text, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		data, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		return validateSettingJSON(fieldType, string(data))
+	case reflect.Map:
+		if strings.HasPrefix(strings.TrimSpace(text), "{") {
+			return validateSettingJSON(fieldType, text)
+		}
+		if fieldType.Elem().Kind() != reflect.String {
+			return nil, fmt.Errorf("expected a json object, key=value pairs can only set text values")
+		}
+		values := map[string]string{}
+		for _, pair := range strings.Split(text, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			key, value, found := strings.Cut(pair, "=")
+			if !found {
+				return nil, fmt.Errorf("expected key=value, got %s", pair)
+			}
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		return json.Marshal(values)
+	default:
+		return validateSettingJSON(fieldType, text)
+	}
+}
+
+func validateSettingJSON(fieldType reflect.Type, text string) (json.RawMessage, error) {
+	err := json.Unmarshal([]byte(text), reflect.New(fieldType).Interface())
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(text), nil
+}
+
+// Returns the environment variable name for a setting, e.g. serverHTTPPort becomes FPPROXY_SERVER_HTTP_PORT
+func settingEnvName(key string) string {
+	runes := []rune(key)
+	var name strings.Builder
+	name.WriteString(settingsEnvPrefix)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			acronymEnd := unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || acronymEnd {
+				name.WriteRune('_')
+			}
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// Writes every effective setting along with the layer it came from
+func printSettings(w io.Writer, settings *ServerSettings, sources settingsSources) {
+	value := reflect.ValueOf(settings).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		key := settingKey(value.Type().Field(i))
+		data, err := json.Marshal(value.Field(i).Interface())
+		if err != nil {
+			data = []byte(err.Error())
+		}
+		source := sources[key]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Fprintf(w, "%-22s %-14s %s\n", key, "("+source+")", data)
+	}
+}
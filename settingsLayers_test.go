@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSettingEnvName(t *testing.T) {
+	names := map[string]string{
+		"proxyPort":        "FPPROXY_PROXY_PORT",
+		"serverHTTPPort":   "FPPROXY_SERVER_HTTP_PORT",
+		"legacyCGIBINPath": "FPPROXY_LEGACY_CGIBIN_PATH",
+		"useMad4FP":        "FPPROXY_USE_MAD4FP",
+		"extMimeTypes":     "FPPROXY_EXT_MIME_TYPES",
+	}
+	for key, expected := range names {
+		if name := settingEnvName(key); name != expected {
+			t.Errorf("expected %s for %s, got %s", expected, key, name)
+		}
+	}
+}
+
+func TestMergeSettingsLayers(t *testing.T) {
+	defaults, err := structLayer("default", defaultServerSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &settingsLayer{name: "file", values: map[string]json.RawMessage{
+		"proxyPort":     json.RawMessage(`"1000"`),
+		"overridePaths": json.RawMessage(`["a", "b"]`),
+		"extMimeTypes":  json.RawMessage(`{"swf": "application/x-shockwave-flash", "txt": "text/plain"}`),
+	}}
+	env, err := envSettingsLayer([]string{
+		"FPPROXY_PROXY_PORT=2000",
+		"FPPROXY_USE_MAD4FP=true",
+		"FPPROXY_OVERRIDE_PATHS=c,d",
+		"FPPROXY_EXT_MIME_TYPES=txt=text/x-test",
+		"OTHER_PROXY_PORT=3000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := flagSettingsLayer([]*settingFlag{{key: "proxyPort", value: "3000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, sources, err := mergeSettingsLayers([]*settingsLayer{defaults, file, env, flags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.ProxyPort != "3000" || sources["proxyPort"] != "flag" {
+		t.Errorf("expected proxyPort 3000 from flag, got %s from %s", settings.ProxyPort, sources["proxyPort"])
+	}
+	if !settings.UseMad4FP || sources["useMad4FP"] != "env" {
+		t.Errorf("expected useMad4FP true from env, got %t from %s", settings.UseMad4FP, sources["useMad4FP"])
+	}
+	if !reflect.DeepEqual(settings.OverridePaths, []string{"c", "d"}) {
+		t.Errorf("expected env to replace overridePaths, got %v", settings.OverridePaths)
+	}
+	if settings.ExtMimeTypes["swf"] != "application/x-shockwave-flash" || settings.ExtMimeTypes["txt"] != "text/x-test" {
+		t.Errorf("expected extMimeTypes to be merged, got %v", settings.ExtMimeTypes)
+	}
+	if sources["extMimeTypes"] != "file+env" {
+		t.Errorf("expected extMimeTypes from file+env, got %s", sources["extMimeTypes"])
+	}
+	if settings.ApiPrefix != "fpProxy/api/" || sources["apiPrefix"] != "default" {
+		t.Errorf("expected default apiPrefix, got %s from %s", settings.ApiPrefix, sources["apiPrefix"])
+	}
+}
+
+func TestSettingTextToJSONInvalid(t *testing.T) {
+	field, _ := settingStructField("useMad4FP")
+	_, err := settingTextToJSON(field.Type, "maybe")
+	if err == nil {
+		t.Error("expected an error for an invalid bool")
+	}
+	field, _ = settingStructField("extMimeTypes")
+	_, err = settingTextToJSON(field.Type, "swf")
+	if err == nil {
+		t.Error("expected an error for a map entry without a value")
+	}
+}
+
+func TestSettingsLayersRejectTextForJsonMaps(t *testing.T) {
+	_, err := envSettingsLayer([]string{"FPPROXY_SITELOCKS=example.com=http://example.com/"})
+	if err == nil || !strings.Contains(err.Error(), "FPPROXY_SITELOCKS") {
+		t.Errorf("expected an error naming FPPROXY_SITELOCKS, got %v", err)
+	}
+	_, err = flagSettingsLayer([]*settingFlag{{key: "corsAllowedOrigins", value: "example.com=http://a.com"}})
+	if err == nil || !strings.Contains(err.Error(), "-corsAllowedOrigins") {
+		t.Errorf("expected an error naming -corsAllowedOrigins, got %v", err)
+	}
+
+	layer, err := envSettingsLayer([]string{`FPPROXY_CORS_ALLOWED_ORIGINS={"example.com": ["http://a.com"]}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(layer.values["corsAllowedOrigins"]) != `{"example.com": ["http://a.com"]}` {
+		t.Errorf("expected the json to be kept, got %s", layer.values["corsAllowedOrigins"])
+	}
+}
+
+func TestLoadServerSettingsInvalid(t *testing.T) {
+	setupTestInstall(t)
+	writeTestSettingsFile(t, `{"rootPath": "`+filepath.ToSlash(cwd)+`", "proxyPort": "70000"}`)
+
+	settings, sources, err := loadServerSettings()
+	var problems SettingsErrors
+	if !errors.As(err, &problems) || len(problems) != 1 || problems[0].Key != "proxyPort" {
+		t.Fatalf("expected a problem with proxyPort, got %v", err)
+	}
+	// Still returned so -print-config can show where the bad value came from
+	if settings == nil || sources["proxyPort"] != "file" {
+		t.Errorf("expected the merged settings and their sources, got %v %v", settings, sources)
+	}
+}
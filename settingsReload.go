@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the settings file is checked for changes
+const settingsPollInterval = 2 * time.Second
+
+// Settings that are only read when the servers start, changing them requires a restart
+var restartRequiredSettings = []string{
+	"rootPath",
+	"gameDataPath",
+	"proxyPort",
+	"serverHTTPPort",
+	"enableHttpsProxy",
+	"enableSocketPolicyServer",
+	"socketPolicyPort",
+	"socksPort",
+	"reverseProxyPort",
+	"apiPrefix",
+}
+
+// Holds the base *ServerSettings, loaded from the settings files. Stored settings must never
+// be modified, changes are made by storing a new copy instead.
+var baseSettingsValue atomic.Value
+
+// Holds the *ServerSettings in use, the base settings with the active profile applied
+var settingsValue atomic.Value
+
+// Serialises reloads so two changes can't race each other
+var settingsReloadMutex sync.Mutex
+
+// Returns the settings currently in use
+func currentSettings() *ServerSettings {
+	settings, _ := settingsValue.Load().(*ServerSettings)
+	return settings
+}
+
+// Returns the settings in use before any profile is applied
+func baseSettings() *ServerSettings {
+	settings, _ := baseSettingsValue.Load().(*ServerSettings)
+	return settings
+}
+
+// Replaces the base settings and reapplies the active profile, requests already in progress
+// keep the settings they started with
+func storeSettings(settings *ServerSettings) {
+	baseSettingsValue.Store(settings)
+	settingsValue.Store(applyActiveProfile(settings))
+}
+
+func settingsFilePath() string {
+	return filepath.Join(cwd, "proxySettings.json")
+}
+
+// Reloads the settings and rewrite rules from disk and swaps them in
+func reloadSettings() error {
+	settingsReloadMutex.Lock()
+	defer settingsReloadMutex.Unlock()
+
+	newSettings, _, err := loadServerSettings()
+	if err != nil {
+		return err
+	}
+	rules, err := loadRewriteRules(rewriteRulesFilePath())
+	if err != nil {
+		return err
+	}
+	swapSettings(newSettings)
+	rewriteRulesValue.Store(rules)
+	return nil
+}
+
+// Swaps in new settings, settings that need a restart keep their old value.
+// Returns the keys that changed and those among them that need a restart.
+// Must be called with settingsReloadMutex held.
+func swapSettings(newSettings *ServerSettings) (changed []string, restartRequired []string) {
+	oldSettings := baseSettings()
+	changed = changedSettings(oldSettings, newSettings)
+	restartRequired = []string{}
+	if len(changed) == 0 {
+		return changed, restartRequired
+	}
+	for _, key := range changed {
+		if isRestartRequired(key) {
+			fmt.Printf("[Settings] %s changed, restart required for it to take effect\n", key)
+			copySettingByKey(newSettings, oldSettings, key)
+			restartRequired = append(restartRequired, key)
+		} else {
+			fmt.Printf("[Settings] %s changed\n", key)
+		}
+	}
+	storeSettings(newSettings)
+	applySettings(currentSettings())
+	return changed, restartRequired
+}
+
+// Updates anything that holds onto a copy of a setting
+func applySettings(settings *ServerSettings) {
+	if proxy != nil {
+		proxy.Verbose = settings.VerboseLogging
+	}
+	syncSocketServers(settings)
+	syncZipServer(settings)
+}
+
+// Polls the settings files and reloads them whenever one is created, modified or removed
+func watchSettingsFiles(filePaths []string, interval time.Duration) {
+	lastStats := map[string]os.FileInfo{}
+	for _, filePath := range filePaths {
+		lastStats[filePath], _ = os.Stat(filePath)
+	}
+	for {
+		time.Sleep(interval)
+		changed := false
+		for _, filePath := range filePaths {
+			stats, _ := os.Stat(filePath)
+			last := lastStats[filePath]
+			if (stats == nil) != (last == nil) || (stats != nil && (!stats.ModTime().Equal(last.ModTime()) || stats.Size() != last.Size())) {
+				fmt.Printf("[Settings] %s changed\n", filePath)
+				lastStats[filePath] = stats
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		err := reloadSettings()
+		if err != nil {
+			fmt.Printf("[Settings] Failed to reload settings, keeping previous settings: %s\n", err)
+		}
+	}
+}
+
+func isRestartRequired(key string) bool {
+	for _, restartKey := range restartRequiredSettings {
+		if restartKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the json keys of every setting that differs between a and b
+func changedSettings(a *ServerSettings, b *ServerSettings) []string {
+	changed := []string{}
+	aValue := reflect.ValueOf(a).Elem()
+	bValue := reflect.ValueOf(b).Elem()
+	for i := 0; i < aValue.NumField(); i++ {
+		if !reflect.DeepEqual(aValue.Field(i).Interface(), bValue.Field(i).Interface()) {
+			changed = append(changed, settingKey(aValue.Type().Field(i)))
+		}
+	}
+	return changed
+}
+
+// Returns the json key of a settings field
+func settingKey(field reflect.StructField) string {
+	key := field.Tag.Get("json")
+	for i, c := range key {
+		if c == ',' {
+			return key[:i]
+		}
+	}
+	return key
+}
+
+// Finds the field for a json key, returns an invalid value if none exists
+func settingField(settings *ServerSettings, key string) reflect.Value {
+	value := reflect.ValueOf(settings).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if settingKey(value.Type().Field(i)) == key {
+			return value.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// Finds the struct field for a json key
+func settingStructField(key string) (reflect.StructField, bool) {
+	settingsType := reflect.TypeOf(ServerSettings{})
+	for i := 0; i < settingsType.NumField(); i++ {
+		if settingKey(settingsType.Field(i)) == key {
+			return settingsType.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func copySettingByKey(dst *ServerSettings, src *ServerSettings, key string) {
+	field := settingField(dst, key)
+	if field.IsValid() {
+		field.Set(settingField(src, key))
+	}
+}
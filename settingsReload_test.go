@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeTestSettingsFile(t *testing.T, data string) {
+	err := os.WriteFile(settingsFilePath(), []byte(data), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Points cwd at a temporary directory holding a minimal valid install
+func setupTestInstall(t *testing.T) {
+	oldCwd := cwd
+	cwd = t.TempDir()
+	t.Cleanup(func() { cwd = oldCwd })
+	err := os.MkdirAll(filepath.Join(cwd, "Data", "Games"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(cwd, "Legacy"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(cwd, "Legacy", "php-cgi.exe"), []byte{}, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadSettings(t *testing.T) {
+	setupTestInstall(t)
+
+	writeTestSettingsFile(t, `{"rootPath": "`+filepath.ToSlash(cwd)+`", "proxyPort": "22500", "useMad4FP": false}`)
+	settings, _, err := loadServerSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeSettings(settings)
+
+	writeTestSettingsFile(t, `{"rootPath": "`+filepath.ToSlash(cwd)+`", "proxyPort": "22700", "useMad4FP": true}`)
+	err = reloadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := currentSettings()
+	if reloaded == settings {
+		t.Fatal("expected settings to be swapped")
+	}
+	if !reloaded.UseMad4FP {
+		t.Error("expected useMad4FP to change without a restart")
+	}
+	if reloaded.ProxyPort != "22500" {
+		t.Errorf("expected proxyPort to keep 22500 until restart, got %s", reloaded.ProxyPort)
+	}
+	if settings.UseMad4FP {
+		t.Error("expected previous settings to be left untouched")
+	}
+}
+
+func TestReloadSettingsInvalid(t *testing.T) {
+	setupTestInstall(t)
+
+	writeTestSettingsFile(t, `{"rootPath": "`+filepath.ToSlash(cwd)+`", "useMad4FP": true}`)
+	settings, _, err := loadServerSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeSettings(settings)
+
+	writeTestSettingsFile(t, `{"useMad4FP": fals`)
+	err = reloadSettings()
+	if err == nil {
+		t.Fatal("expected an error reloading invalid settings")
+	}
+	if currentSettings() != settings {
+		t.Error("expected previous settings to stay in use")
+	}
+}
+
+func TestReloadSettingsRebuildsZipServer(t *testing.T) {
+	setupTestInstall(t)
+	zipPath := filepath.Join(cwd, "Data", "Games", "game.zip")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := zip.NewWriter(zipFile)
+	w, err := writer.Create("content/example.com/game/index.custom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("custom index"))
+	writer.Close()
+	zipFile.Close()
+
+	writeTestSettingsFile(t, `{"rootPath": "`+filepath.ToSlash(cwd)+`", "extIndexTypes": ["html"]}`)
+	settings, _, err := loadServerSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeSettings(settings)
+	previousZipServer := zipServer
+	t.Cleanup(func() { zipServer = previousZipServer })
+	zipServer = newZipServer(currentSettings())
+	recorder := httptest.NewRecorder()
+	zipServer.ServeHTTP(recorder, makeNewRequest("POST", "http://127.0.0.1/fpProxy/api/mountzip", bytes.NewBufferString(`{"filePath": "game.zip"}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("failed to mount test zip: %s", recorder.Body.String())
+	}
+
+	fetchIndex := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		zipServer.ServeHTTP(recorder, makeNewRequest("GET", "http://127.0.0.1/content/example.com/game/", nil))
+		return recorder
+	}
+	if recorder := fetchIndex(); recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected no index before the reload, got %d", recorder.Code)
+	}
+	// Left unread, so the request is still being served during the reload
+	previousHandler := zipServer.(*reloadableZipServer).handler
+	inFlight := serveInProcess(zipServer, makeNewRequest("GET", "http://127.0.0.1/content/example.com/game/index.custom", nil))
+
+	writeTestSettingsFile(t, `{"rootPath": "`+filepath.ToSlash(cwd)+`", "extIndexTypes": ["html", "custom"], "overridePaths": ["override"]}`)
+	err = reloadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder := fetchIndex(); recorder.Code != http.StatusOK || recorder.Body.String() != "custom index" {
+		t.Errorf("expected the remounted zip to be served with the new index types, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if !reflect.DeepEqual(currentSettings().OverridePaths, []string{"override"}) {
+		t.Errorf("expected overridePaths to change without a restart, got %v", currentSettings().OverridePaths)
+	}
+
+	if mounted, _ := listZipMounts(previousHandler, "fpProxy/api/"); len(mounted) != 1 {
+		t.Fatalf("expected the previous zip server to keep its zip while serving a request, got %v", mounted)
+	}
+	body, err := io.ReadAll(inFlight.Body)
+	inFlight.Body.Close()
+	if err != nil || string(body) != "custom index" {
+		t.Errorf("expected the request in progress to finish, got %q %v", body, err)
+	}
+	select {
+	case <-previousHandler.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the previous zip server to be closed once its request finished")
+	}
+	if mounted, _ := listZipMounts(previousHandler, "fpProxy/api/"); len(mounted) != 0 {
+		t.Errorf("expected the previous zip server's zips to be unmounted, got %v", mounted)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit code used when the settings are invalid, so the launcher can tell the user to fix them
+// (EX_CONFIG from sysexits.h)
+const exitCodeInvalidSettings = 78
+
+// A problem with a single setting
+type SettingError struct {
+	Key     string `json:"key"`
+	Source  string `json:"source,omitempty"`
+	Message string `json:"msg"`
+}
+
+func (e SettingError) Error() string {
+	if e.Source != "" {
+		return fmt.Sprintf("%s (%s): %s", e.Key, e.Source, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Key, e.Message)
+}
+
+// Every problem found with the settings
+type SettingsErrors []SettingError
+
+func (e SettingsErrors) Error() string {
+	messages := []string{}
+	for _, settingErr := range e {
+		messages = append(messages, settingErr.Error())
+	}
+	return fmt.Sprintf("%d invalid settings: %s", len(e), strings.Join(messages, "; "))
+}
+
+// Checks every layer for unknown keys and values of the wrong type, removing them so the
+// remaining layers can still be merged and validated
+func validateSettingsLayers(layers []*settingsLayer) SettingsErrors {
+	problems := SettingsErrors{}
+	for _, layer := range layers {
+		keys := []string{}
+		for key := range layer.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, known := settingStructField(key)
+			if !known {
+				problems = append(problems, SettingError{Key: key, Source: layer.name, Message: "unknown setting"})
+				delete(layer.values, key)
+				continue
+			}
+			err := json.Unmarshal(layer.values[key], reflect.New(field.Type).Interface())
+			if err != nil {
+				var typeErr *json.UnmarshalTypeError
+				message := err.Error()
+				if errors.As(err, &typeErr) {
+					message = fmt.Sprintf("expected %s, got %s", field.Type, typeErr.Value)
+				}
+				problems = append(problems, SettingError{Key: key, Source: layer.name, Message: message})
+				delete(layer.values, key)
+				continue
+			}
+			if key == "hostAliases" {
+				problems = append(problems, hostAliasClashes(layer)...)
+			}
+		}
+	}
+	return problems
+}
+
+// Reports host alias patterns in a layer that only differ by case but alias different hosts, as
+// they're lowercased when merged and only one can be kept
+func hostAliasClashes(layer *settingsLayer) SettingsErrors {
+	aliases := map[string]string{}
+	json.Unmarshal(layer.values["hostAliases"], &aliases)
+	patterns := []string{}
+	for pattern := range aliases {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	problems := SettingsErrors{}
+	lowerAliases := map[string]string{}
+	for _, pattern := range patterns {
+		lowerPattern := strings.ToLower(pattern)
+		if existing, ok := lowerAliases[lowerPattern]; ok && !strings.EqualFold(existing, aliases[pattern]) {
+			message := fmt.Sprintf("%s is already aliased to %s", lowerPattern, existing)
+			problems = append(problems, SettingError{Key: "hostAliases." + pattern, Source: layer.name, Message: message})
+			continue
+		}
+		lowerAliases[lowerPattern] = aliases[pattern]
+	}
+	return problems
+}
+
+// Returns the keys of the port settings the servers listen on with these settings
+func portSettingsInUse(settings *ServerSettings) []string {
+	ports := []string{"proxyPort", "serverHTTPPort"}
+	if !settings.HandleLegacyRequests {
+		ports = append(ports, "externalLegacyPort")
+	}
+	if settings.EnableSocketPolicyServer {
+		ports = append(ports, "socketPolicyPort")
+	}
+	if settings.SocksPort != "" {
+		ports = append(ports, "socksPort")
+	}
+	if settings.ReverseProxyPort != "" {
+		ports = append(ports, "reverseProxyPort")
+	}
+	return ports
+}
+
+// Checks the merged settings for problems that would stop the server from working
+func validateSettings(settings *ServerSettings) SettingsErrors {
+	problems := SettingsErrors{}
+	addProblem := func(key string, format string, args ...interface{}) {
+		problems = append(problems, SettingError{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Ports, making sure none of the ones in use collide
+	usedPorts := map[int]string{}
+	for _, key := range portSettingsInUse(settings) {
+		value := settingField(settings, key).String()
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			addProblem(key, "invalid port %q, must be a number from 1 to 65535", value)
+			continue
+		}
+		if otherKey, used := usedPorts[port]; used {
+			addProblem(key, "port %d is already used by %s", port, otherKey)
+			continue
+		}
+		usedPorts[port] = key
+	}
+
+	// Directories
+	dirs := []string{"gameDataPath"}
+	if settings.HandleLegacyRequests {
+		dirs = append(dirs, "legacyHTDOCSPath", "legacyCGIBINPath")
+	}
+	for _, key := range dirs {
+		dir := settingField(settings, key).String()
+		stats, err := os.Stat(dir)
+		if err != nil {
+			addProblem(key, "directory %s does not exist", dir)
+		} else if !stats.IsDir() {
+			addProblem(key, "%s is not a directory", dir)
+		}
+	}
+
+	// PHP executable, needed by the legacy source for scripts in htdocs. The zip server runs it for
+	// scripts in GameZIPs too, but most games have none, so without the legacy source a missing
+	// executable is only warned about. Installs without PHP leave it empty.
+	if settings.PhpCgiPath != "" {
+		problem := ""
+		stats, err := os.Stat(settings.PhpCgiPath)
+		if err != nil {
+			problem = fmt.Sprintf("%s does not exist", settings.PhpCgiPath)
+		} else if stats.IsDir() {
+			problem = fmt.Sprintf("%s is a directory", settings.PhpCgiPath)
+		} else if runtime.GOOS != "windows" && stats.Mode()&0111 == 0 {
+			problem = fmt.Sprintf("%s is not executable", settings.PhpCgiPath)
+		}
+		if problem != "" {
+			if usesContentSource(settings, "legacy") {
+				addProblem("phpCgiPath", "%s", problem)
+			} else {
+				fmt.Printf("[Settings] Warning: phpCgiPath %s, PHP scripts in GameZIPs won't run\n", problem)
+			}
+		}
+	}
+
+	// Online servers
+	if settings.UseInfinityServer || settings.InfinityServerURL != "" {
+		err := validateServerURL(settings.InfinityServerURL)
+		if err != nil {
+			addProblem("infinityServerURL", "%s", err)
+		}
+	}
+	for i, mirror := range settings.ExternalFilePaths {
+		err := validateServerURL(mirror)
+		if err != nil {
+			addProblem(fmt.Sprintf("externalFilePaths[%d]", i), "%s", err)
+		}
+	}
+
+	// Mime types
+	exts := []string{}
+	for ext := range settings.ExtMimeTypes {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	for _, ext := range exts {
+		_, _, err := mime.ParseMediaType(settings.ExtMimeTypes[ext])
+		if err != nil {
+			addProblem("extMimeTypes."+ext, "invalid media type %q: %s", settings.ExtMimeTypes[ext], err)
+		}
+	}
+
+	// Host aliases, already lowercased when the layers were merged
+	patterns := []string{}
+	for pattern := range settings.HostAliases {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if problem := validateHostAlias(pattern, settings.HostAliases[pattern]); problem != "" {
+			addProblem("hostAliases."+pattern, "%s", problem)
+		}
+	}
+
+	// Content sources
+	seenSources := map[string]bool{}
+	for i, options := range settings.ContentSources {
+		key := fmt.Sprintf("contentSources[%d]", i)
+		if _, ok := contentSources[options.Name]; !ok {
+			addProblem(key, "unknown content source %q", options.Name)
+		} else if seenSources[options.Name] {
+			addProblem(key, "content source %s is already in the chain", options.Name)
+		}
+		seenSources[options.Name] = true
+		if options.Timeout != "" {
+			timeout, err := time.ParseDuration(options.Timeout)
+			if err != nil || timeout <= 0 {
+				addProblem(key, "invalid timeout %q, must be a duration such as 30s", options.Timeout)
+			}
+		}
+	}
+
+	problems = append(problems, validateCorsAllowedOrigins(settings)...)
+	problems = append(problems, validateSitelocks(settings)...)
+	problems = append(problems, validateWebsockets(settings)...)
+	problems = append(problems, validateSocketServers(settings)...)
+	problems = append(problems, validateCompression(settings)...)
+	problems = append(problems, validateProfiles(settings)...)
+
+	return problems
+}
+
+func validateServerURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %s", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL %q, must start with http:// or https://", rawURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL %q, missing host", rawURL)
+	}
+	return nil
+}
+
+// Reports why the settings couldn't be loaded and exits with exitCodeInvalidSettings
+func exitWithSettingsError(w io.Writer, err error) {
+	var problems SettingsErrors
+	if errors.As(err, &problems) {
+		fmt.Fprintf(w, "Invalid settings, %d problem(s) found:\n", len(problems))
+		for _, problem := range problems {
+			fmt.Fprintf(w, "  %s\n", problem.Error())
+		}
+	} else {
+		fmt.Fprintf(w, "Failed to load settings: %s\n", err)
+	}
+	os.Exit(exitCodeInvalidSettings)
+}
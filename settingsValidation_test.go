@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateSettings(t *testing.T) {
+	setupTestInstall(t)
+
+	settings := defaultServerSettings()
+	settings.RootPath = cwd
+	settings.ProxyPort = "22500"
+	settings.ServerHTTPPort = "22500"
+	settings.ExternalLegacyPort = "70000"
+	settings.InfinityServerURL = "infinity.flashpointarchive.org"
+	settings.ExtMimeTypes = map[string]string{"swf": "application/x-shockwave-flash", "bad": "not a mime"}
+	settings.HostAliases = map[string]string{"*.example.com": "example.com", "cdn*.example.com": "example.com"}
+	settings.ContentSources = []ContentSourceOptions{{Name: "zip"}, {Name: "zip"}, {Name: "ftp"}, {Name: "legacy", Timeout: "soon"}}
+	settings.Websockets = map[string]WebsocketEndpoint{"chat.example.com": {Mode: "record"}, "game.example.com": {Mode: "transcript"}}
+	err := resolveSettingsPaths(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems := validateSettings(settings)
+	expected := map[string]bool{
+		"serverHTTPPort":                         false,
+		"externalLegacyPort":                     false,
+		"infinityServerURL":                      false,
+		"extMimeTypes.bad":                       false,
+		"hostAliases.cdn*.example.com":           false,
+		"contentSources[1]":                      false,
+		"contentSources[2]":                      false,
+		"contentSources[3]":                      false,
+		"websockets.chat.example.com.mode":       false,
+		"websockets.game.example.com.transcript": false,
+	}
+	for _, problem := range problems {
+		if _, ok := expected[problem.Key]; !ok {
+			t.Errorf("unexpected problem %s", problem.Error())
+		}
+		expected[problem.Key] = true
+	}
+	for key, found := range expected {
+		if !found {
+			t.Errorf("expected a problem with %s", key)
+		}
+	}
+}
+
+func TestValidateSettingsMissingPaths(t *testing.T) {
+	settings := defaultServerSettings()
+	settings.RootPath = filepath.Join(t.TempDir(), "missing")
+	settings.HandleLegacyRequests = true
+	err := resolveSettingsPaths(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems := validateSettings(settings)
+	keys := map[string]bool{}
+	for _, problem := range problems {
+		keys[problem.Key] = true
+	}
+	for _, key := range []string{"gameDataPath", "legacyHTDOCSPath", "legacyCGIBINPath", "phpCgiPath"} {
+		if !keys[key] {
+			t.Errorf("expected a problem with %s", key)
+		}
+	}
+}
+
+func TestValidateSettingsPhpWithoutLegacyRequests(t *testing.T) {
+	setupTestInstall(t)
+	settings := defaultServerSettings()
+	settings.RootPath = cwd
+	settings.HandleLegacyRequests = false
+	settings.PhpCgiPath = filepath.Join(cwd, "missing", "php-cgi")
+	err := resolveSettingsPaths(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only warned about, as nothing needs PHP to start
+	if problems := validateSettings(settings); len(problems) != 0 {
+		t.Errorf("expected a missing phpCgiPath without the legacy source to be allowed, got %v", problems)
+	}
+
+	// The legacy source can't work without it
+	settings.ContentSources = []ContentSourceOptions{{Name: "zip", Enabled: true}, {Name: "legacy", Enabled: true}}
+	problems := validateSettings(settings)
+	if len(problems) != 1 || problems[0].Key != "phpCgiPath" {
+		t.Errorf("expected a problem with phpCgiPath, got %v", problems)
+	}
+	settings.ContentSources = nil
+
+	settings.PhpCgiPath = ""
+	err = resolveSettingsPaths(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := validateSettings(settings); len(problems) != 0 {
+		t.Errorf("expected an empty phpCgiPath to be allowed, got %v", problems)
+	}
+}
+
+func TestSettingsLayersLowerHostAliases(t *testing.T) {
+	base := &settingsLayer{name: "file", values: map[string]json.RawMessage{
+		"hostAliases": json.RawMessage(`{"*.CDN.Example.com": "Example.com", "Mirror.com": "a.com", "mirror.com": "b.com"}`),
+	}}
+	overlay := &settingsLayer{name: "user", values: map[string]json.RawMessage{
+		"hostAliases": json.RawMessage(`{"*.cdn.EXAMPLE.com": "other.com"}`),
+	}}
+	layers := []*settingsLayer{base, overlay}
+
+	problems := validateSettingsLayers(layers)
+	if len(problems) != 1 || problems[0].Key != "hostAliases.mirror.com" || problems[0].Source != "file" {
+		t.Errorf("expected a problem with the clashing mirror.com aliases, got %v", problems)
+	}
+	settings, _, err := mergeSettingsLayers(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alias := hostAlias(settings, "www.cdn.example.com"); alias != "other.com" {
+		t.Errorf("expected the later layer's other.com, got %q", alias)
+	}
+	if len(settings.HostAliases) != 2 {
+		t.Errorf("expected patterns differing by case to be merged, got %v", settings.HostAliases)
+	}
+
+	// Validation leaves the merged settings alone
+	settings.HostAliases["Upper.com"] = "example.com"
+	validateSettings(settings)
+	if _, ok := settings.HostAliases["Upper.com"]; !ok {
+		t.Errorf("expected validateSettings not to change host aliases, got %v", settings.HostAliases)
+	}
+}
+
+func TestValidateSettingsLayers(t *testing.T) {
+	layer := &settingsLayer{name: "file", values: map[string]json.RawMessage{
+		"proxyPort":  json.RawMessage(`22500`),
+		"proxyPrt":   json.RawMessage(`"22500"`),
+		"useMad4FP":  json.RawMessage(`true`),
+		"apiPrefix":  json.RawMessage(`"fpProxy/api/"`),
+		"verboseLog": json.RawMessage(`true`),
+	}}
+
+	problems := validateSettingsLayers([]*settingsLayer{layer})
+	if len(problems) != 3 {
+		t.Fatalf("expected 3 problems, got %d: %s", len(problems), problems)
+	}
+	if _, ok := layer.values["proxyPort"]; ok {
+		t.Error("expected invalid proxyPort to be removed from the layer")
+	}
+	if _, ok := layer.values["useMad4FP"]; !ok {
+		t.Error("expected valid useMad4FP to be kept")
+	}
+
+	var err error = problems
+	var settingsErrors SettingsErrors
+	if !errors.As(err, &settingsErrors) {
+		t.Error("expected problems to be usable as an error")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+/** Sitelocks
+ * Flash and Shockwave games often refuse to run unless they're on the site they were made for,
+ * checking the Referer, the Origin or the URL of the page they're embedded in. "sitelocks" holds
+ * the fixes for each host (exact, or *. for any subdomain):
+ *   "sitelocks": {
+ *     "chat.kongregate.com": {"referer": "http://www.kongregate.com/games/dev/game", "origin": "http://www.kongregate.com"},
+ *     "www.kongregate.com": {"pages": {"/games/dev/game": {"src": "http://chat.kongregate.com/gamez/0001/game.swf"}}}
+ *   }
+ * - referer and origin replace the headers sent to the legacy, external and MAD4FP sources
+ * - pages are synthetic embedding pages served by the "sitelock" content source, so a game
+ *   launched at the page's URL sees the original site as its page URL
+ * Like any other setting they can be set by a profile, so only the game that needs them uses them.
+ */
+
+// Fixes for a single host's sitelock
+type SitelockOptions struct {
+	Referer string                  `json:"referer,omitempty"`
+	Origin  string                  `json:"origin,omitempty"`
+	Pages   map[string]SitelockPage `json:"pages,omitempty"`
+}
+
+// A synthetic page embedding a game
+type SitelockPage struct {
+	// URL of the SWF or DCR to embed
+	Src       string `json:"src"`
+	Title     string `json:"title,omitempty"`
+	Width     string `json:"width,omitempty"`
+	Height    string `json:"height,omitempty"`
+	FlashVars string `json:"flashVars,omitempty"`
+}
+
+var sitelockPageTemplate = template.Must(template.New("sitelock").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>html, body { margin: 0; height: 100%; background: #000; overflow: hidden; }</style>
+</head>
+<body>
+<object type="{{.Type}}" data="{{.Src}}" width="{{.Width}}" height="{{.Height}}">
+<param name="movie" value="{{.Src}}">
+<param name="src" value="{{.Src}}">
+<param name="flashvars" value="{{.FlashVars}}">
+<param name="allowScriptAccess" value="always">
+<embed type="{{.Type}}" src="{{.Src}}" width="{{.Width}}" height="{{.Height}}" flashvars="{{.FlashVars}}" allowScriptAccess="always">
+</object>
+</body>
+</html>
+`))
+
+// Returns the sitelock fixes for a host, if any
+func sitelockFor(settings *ServerSettings, host string) (SitelockOptions, bool) {
+	patterns := []string{}
+	for pattern := range settings.Sitelocks {
+		patterns = append(patterns, pattern)
+	}
+	pattern := bestHostPattern(strings.ToLower(host), patterns)
+	if pattern == "" {
+		return SitelockOptions{}, false
+	}
+	return settings.Sitelocks[pattern], true
+}
+
+// Replaces the Referer and Origin of a request going to a legacy source, if its host has a sitelock
+func applySitelockHeaders(settings *ServerSettings, r *http.Request) {
+	sitelock, ok := sitelockFor(settings, r.URL.Host)
+	if !ok || (sitelock.Referer == "" && sitelock.Origin == "") {
+		return
+	}
+	// The headers are shared with the original request, change a copy
+	r.Header = r.Header.Clone()
+	if sitelock.Referer != "" {
+		r.Header.Set("Referer", sitelock.Referer)
+	}
+	if sitelock.Origin != "" {
+		r.Header.Set("Origin", sitelock.Origin)
+	}
+	if settings.VerboseLogging {
+		fmt.Printf("[Sitelock] Spoofing Referer %q and Origin %q for %s\n", sitelock.Referer, sitelock.Origin, r.URL)
+	}
+}
+
+// Serves the synthetic embedding pages set in "sitelocks"
+type sitelockContentSource struct{}
+
+func (sitelockContentSource) Fetch(r *http.Request, body *replayableBody, settings *ServerSettings, options ContentSourceOptions) (*http.Response, error) {
+	return serveInProcess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !serveSitelockPage(w, r, settings) {
+			http.NotFound(w, r)
+		}
+	}), r), nil
+}
+
+// Serves a synthetic page embedding the game, if one is set for the URL.
+// Returns false without writing anything if there isn't one.
+func serveSitelockPage(w http.ResponseWriter, r *http.Request, settings *ServerSettings) bool {
+	sitelock, ok := sitelockFor(settings, r.URL.Host)
+	if !ok {
+		return false
+	}
+	page, ok := sitelock.Pages[r.URL.Path]
+	if !ok {
+		page, ok = sitelock.Pages[strings.TrimSuffix(r.URL.Path, "/")]
+	}
+	if !ok {
+		return false
+	}
+
+	data := struct {
+		SitelockPage
+		Type string
+	}{SitelockPage: page, Type: "application/x-shockwave-flash"}
+	if data.Title == "" {
+		data.Title = r.URL.Host
+	}
+	if data.Width == "" {
+		data.Width = "100%"
+	}
+	if data.Height == "" {
+		data.Height = "100%"
+	}
+	if src, err := url.Parse(page.Src); err == nil {
+		ext := strings.TrimPrefix(strings.ToLower(path.Ext(src.Path)), ".")
+		if mimeType := settings.ExtMimeTypes[ext]; mimeType != "" {
+			data.Type = mimeType
+		}
+	}
+
+	fmt.Printf("[Sitelock] Serving embedding page for %s\n", r.URL)
+	// Served as an html file, there's no real file behind it
+	w.Header().Set("ZIPSVR_FILENAME", path.Join(r.URL.Host, r.URL.Path, "index.html"))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Fpproxy-Sitelock", "page")
+	err := sitelockPageTemplate.Execute(w, data)
+	if err != nil {
+		fmt.Printf("[Sitelock] Error writing embedding page: %s\n", err)
+	}
+	return true
+}
+
+// Checks the sitelock settings, returning every problem found
+func validateSitelocks(settings *ServerSettings) SettingsErrors {
+	problems := SettingsErrors{}
+	patterns := []string{}
+	for pattern := range settings.Sitelocks {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		key := "sitelocks." + pattern
+		sitelock := settings.Sitelocks[pattern]
+		if problem := validateHostPattern(pattern); problem != "" {
+			problems = append(problems, SettingError{Key: key, Message: problem})
+		}
+		for _, header := range []struct{ name, value string }{{"referer", sitelock.Referer}, {"origin", sitelock.Origin}} {
+			if header.value == "" {
+				continue
+			}
+			if err := validateServerURL(header.value); err != nil {
+				problems = append(problems, SettingError{Key: key + "." + header.name, Message: err.Error()})
+			}
+		}
+		pagePaths := []string{}
+		for pagePath := range sitelock.Pages {
+			pagePaths = append(pagePaths, pagePath)
+		}
+		sort.Strings(pagePaths)
+		for _, pagePath := range pagePaths {
+			if !strings.HasPrefix(pagePath, "/") {
+				problems = append(problems, SettingError{Key: key + ".pages." + pagePath, Message: "page path must start with /"})
+			}
+			if sitelock.Pages[pagePath].Src == "" {
+				problems = append(problems, SettingError{Key: key + ".pages." + pagePath, Message: "missing src"})
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSitelockRefererSpoofing(t *testing.T) {
+	referers := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		referers <- r.Header.Get("Referer")
+		w.Write([]byte("external swf"))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	settings := testServerSettings
+	settings.HandleLegacyRequests = false
+	settings.ExternalLegacyPort = port
+	settings.Sitelocks = map[string]SitelockOptions{
+		"*.example.com": {Referer: "http://www.kongregate.com/games/dev/game"},
+	}
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{})
+
+	r := httptest.NewRequest("GET", "http://cdn.example.com/game.swf", nil)
+	r.Header.Set("Referer", "http://localhost/")
+	_, resp := handleRequest(r, nil)
+	readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+	if referer := <-referers; referer != "http://www.kongregate.com/games/dev/game" {
+		t.Errorf("expected spoofed referer, got %s", referer)
+	}
+	if r.Header.Get("Referer") != "http://localhost/" {
+		t.Errorf("expected the original request to keep its referer")
+	}
+}
+
+func TestSitelockEmbeddingPage(t *testing.T) {
+	settings := testServerSettings
+	settings.HandleLegacyRequests = true
+	settings.Sitelocks = map[string]SitelockOptions{
+		"www.kongregate.com": {Pages: map[string]SitelockPage{
+			"/games/dev/game": {Src: "http://chat.kongregate.com/gamez/0001/game.swf", FlashVars: "a=1&b=2"},
+		}},
+	}
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{})
+
+	_, resp := handleRequest(httptest.NewRequest("GET", "http://www.kongregate.com/games/dev/game", nil), nil)
+	body := readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Fpproxy-Sitelock") != "page" {
+		t.Errorf("expected the sitelock header")
+	}
+	if !bytes.Contains(body, []byte(`src="http://chat.kongregate.com/gamez/0001/game.swf"`)) {
+		t.Errorf("expected the page to embed the game, got %s", body)
+	}
+	if !bytes.Contains(body, []byte(`flashvars="a=1&amp;b=2"`)) {
+		t.Errorf("expected escaped flashvars, got %s", body)
+	}
+
+	_, resp = handleRequest(httptest.NewRequest("GET", "http://www.kongregate.com/games/dev/other", nil), nil)
+	readTestResponse(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status code 404 for other pages, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/** Socket policies
+ * Before opening an XMLSocket or Socket, Flash Player sends <policy-file-request/> followed by a
+ * null byte, first to port 843 and then to the port it's connecting to, and waits 3 seconds for a
+ * policy before giving up. Policies are answered:
+ * - on socketPolicyPort (843 by default) when enableSocketPolicyServer is on
+ * - inline on the proxy port, for games connecting to it directly
+ * - inline on emulated socket servers, see socketServers.go
+ * The policy served is an archived one for the host when it's known and one was archived, saved
+ * like any other file as crossdomain.xml under host_843 (or the bare host) with a to-ports
+ * attribute. Otherwise it allows every port when allowCrossDomain is on, and nothing when it's off
+ * so the game fails straight away instead of waiting.
+ * Policy requests don't say which host they're for, so only emulated socket servers know theirs
+ * from their "host" option. The policy port and the proxy port use the host of the socket servers
+ * when they all share one, which covers the usual single game, and fall back otherwise.
+ */
+
+// Sent by Flash Player to ask for a socket policy
+const socketPolicyRequest = "<policy-file-request/>"
+
+// Port Flash Player asks for socket policies on first
+const flashSocketPolicyPort = "843"
+
+// How long a policy connection may take to send its request
+const socketPolicyTimeout = 10 * time.Second
+
+// Largest archived policy read
+const socketPolicyLimit = 64 * 1024
+
+// Socket policy allowing connections to any port from anywhere
+const permissiveSocketPolicy = `<?xml version="1.0"?>
+<!DOCTYPE cross-domain-policy SYSTEM "http://www.adobe.com/xml/dtds/cross-domain-policy.dtd">
+<cross-domain-policy>
+  <site-control permitted-cross-domain-policies="master-only"/>
+  <allow-access-from domain="*" to-ports="*"/>
+</cross-domain-policy>
+`
+
+// Socket policy allowing nothing
+const emptySocketPolicy = `<?xml version="1.0"?>
+<cross-domain-policy>
+</cross-domain-policy>
+`
+
+// Returns the socket policy for a host, which may be "" if it isn't known
+func socketPolicyFor(settings *ServerSettings, host string) string {
+	if host != "" {
+		if policy := archivedSocketPolicy(settings, host); policy != "" {
+			fmt.Printf("[Policy] Serving archived socket policy for %s\n", host)
+			return policy
+		}
+	}
+	if settings.AllowCrossDomain {
+		return permissiveSocketPolicy
+	}
+	return emptySocketPolicy
+}
+
+// Returns the host policy requests without one of their own are answered for, which is the host
+// every socket server with one shares, or "" if there's none or they differ
+func sharedSocketPolicyHost(settings *ServerSettings) string {
+	host := ""
+	for _, options := range settings.SocketServers {
+		if options.Host == "" {
+			continue
+		}
+		if host != "" && !strings.EqualFold(host, options.Host) {
+			return ""
+		}
+		host = options.Host
+	}
+	return strings.ToLower(host)
+}
+
+// Looks for a socket policy archived for a host in the GameZIP and htdocs, returning "" if there
+// isn't one. HTTP policies are skipped, Flash rejects socket policies without to-ports.
+func archivedSocketPolicy(settings *ServerSettings, host string) string {
+	r, err := http.NewRequest("GET", "http://"+net.JoinHostPort(strings.Trim(host, "[]"), flashSocketPolicyPort)+"/crossdomain.xml", nil)
+	if err != nil {
+		return ""
+	}
+	r = stripRequestPort(r)
+	sources := []ContentSource{zipContentSource{}}
+	if settings.HandleLegacyRequests {
+		sources = append(sources, legacyContentSource{})
+	}
+	for _, source := range sources {
+		resp, err := source.Fetch(r, &replayableBody{}, settings, ContentSourceOptions{Enabled: true})
+		if err != nil {
+			continue
+		}
+		policy, err := io.ReadAll(io.LimitReader(resp.Body, socketPolicyLimit))
+		resp.Body.Close()
+		if err == nil && resp.StatusCode == http.StatusOK && bytes.Contains(policy, []byte("to-ports")) {
+			return string(policy)
+		}
+	}
+	return ""
+}
+
+// Returns whether a connection starts with a policy request, without consuming anything else.
+// Only blocks for the rest of the request if the first byte could start one.
+func isSocketPolicyRequest(reader *bufio.Reader) bool {
+	first, err := reader.Peek(1)
+	if err != nil || first[0] != '<' {
+		return false
+	}
+	request, err := reader.Peek(len(socketPolicyRequest))
+	return err == nil && string(request) == socketPolicyRequest
+}
+
+// Answers a policy request at the start of a connection, the request must already have been
+// checked with isSocketPolicyRequest
+func serveSocketPolicy(settings *ServerSettings, conn net.Conn, reader *bufio.Reader, host string) {
+	reader.Discard(len(socketPolicyRequest))
+	// The request ends in a null byte, drop it if it's already arrived
+	if next, err := reader.Peek(reader.Buffered()); err == nil && len(next) > 0 && next[0] == 0 {
+		reader.Discard(1)
+	}
+	if settings.VerboseLogging {
+		fmt.Printf("[Policy] Serving socket policy to %s\n", conn.RemoteAddr())
+	}
+	conn.Write(append([]byte(socketPolicyFor(settings, host)), 0))
+}
+
+// Serves socket policies on a port, for Flash Player's first request
+func listenSocketPolicies(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Socket Policy Server started on", address)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(socketPolicyTimeout))
+			reader := bufio.NewReader(conn)
+			if isSocketPolicyRequest(reader) {
+				settings := currentSettings()
+				serveSocketPolicy(settings, conn, reader, sharedSocketPolicyHost(settings))
+			}
+		}()
+	}
+}
+
+// Answers policy requests sent straight to a listener's port, passing every other connection on
+type socketPolicyListener struct {
+	net.Listener
+}
+
+func (l socketPolicyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &socketPolicyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// A connection that's checked for a policy request on its first read, so a slow client can't hold
+// up the listener
+type socketPolicyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	checked bool
+}
+
+func (c *socketPolicyConn) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		if isSocketPolicyRequest(c.reader) {
+			settings := currentSettings()
+			serveSocketPolicy(settings, c.Conn, c.reader, sharedSocketPolicyHost(settings))
+			c.Conn.Close()
+			return 0, io.EOF
+		}
+	}
+	return c.reader.Read(p)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSocketPolicyListener(t *testing.T) {
+	settings := testServerSettings
+	settings.AllowCrossDomain = true
+	setup(&settings)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(socketPolicyListener{listener}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("success"))
+	}))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(socketPolicyRequest + "\x00"))
+	policy, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(policy), `to-ports="*"`) || !strings.HasSuffix(string(policy), "\x00") {
+		t.Errorf("expected a null terminated permissive policy, got %q", policy)
+	}
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readTestResponse(t, resp); string(body) != "success" {
+		t.Errorf("expected HTTP requests to be passed on, got %s", body)
+	}
+}
+
+func TestSocketPolicyFor(t *testing.T) {
+	settings := testServerSettings
+	settings.AllowCrossDomain = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com_843/crossdomain.xml": `<cross-domain-policy><allow-access-from domain="*" to-ports="9339"/></cross-domain-policy>`,
+		"content/other.com/crossdomain.xml":       `<cross-domain-policy><allow-access-from domain="*"/></cross-domain-policy>`,
+	})
+
+	if policy := socketPolicyFor(&settings, "example.com"); !strings.Contains(policy, `to-ports="9339"`) {
+		t.Errorf("expected archived policy, got %s", policy)
+	}
+	if policy := socketPolicyFor(&settings, "other.com"); policy != permissiveSocketPolicy {
+		t.Errorf("expected HTTP policy to be skipped, got %s", policy)
+	}
+	settings.AllowCrossDomain = false
+	if policy := socketPolicyFor(&settings, ""); policy != emptySocketPolicy {
+		t.Errorf("expected empty policy, got %s", policy)
+	}
+}
+
+func TestSocketPolicyListenerSharedHost(t *testing.T) {
+	settings := testServerSettings
+	settings.AllowCrossDomain = true
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com_843/crossdomain.xml": `<cross-domain-policy><allow-access-from domain="*" to-ports="9339"/></cross-domain-policy>`,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(socketPolicyListener{listener}, http.NotFoundHandler())
+	requestPolicy := func() string {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(socketPolicyRequest + "\x00"))
+		policy, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(policy)
+	}
+
+	settings.SocketServers = map[string]SocketServerOptions{
+		"9339": {Rules: "chat.json", Host: "Example.com"},
+		"9340": {Rules: "lobby.json"},
+	}
+	storeSettings(&settings)
+	if policy := requestPolicy(); !strings.Contains(policy, `to-ports="9339"`) {
+		t.Errorf("expected the shared host's archived policy, got %q", policy)
+	}
+
+	// With no single host to go by, the fallback is served
+	settings.SocketServers["9341"] = SocketServerOptions{Rules: "other.json", Host: "other.com"}
+	storeSettings(&settings)
+	if policy := requestPolicy(); !strings.Contains(policy, `to-ports="*"`) {
+		t.Errorf("expected the permissive fallback policy, got %q", policy)
+	}
+}
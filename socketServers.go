@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/FlashpointProject/zipfs"
+)
+
+/** Socket servers
+ * Chat and multiplayer games connect with XMLSocket or Socket to servers long gone. An emulated
+ * server listens on a port and answers from a rules file, so at least the single player parts of
+ * these games can load. Servers are set under "socketServers" by port, usually from a game's
+ * profile so they only run while it does:
+ *   "socketServers": {"9339": {"rules": "Sockets/game.json", "host": "game.example.com"}}
+ * or started and stopped through the api with POST and DELETE on <apiPrefix>sockets.
+ * The rules file is read for each connection, so it can be edited while curating:
+ *   {
+ *     "delimiter": "\u0000",
+ *     "greeting": ["<msg t='sys'><body action='ready'/></msg>"],
+ *     "transcript": [{"from": "client", "data": "..."}, {"from": "server", "data": "...", "delay": "100ms"}],
+ *     "rules": [{"match": "action='login'", "reply": ["<msg t='sys'><body action='logOK'/></msg>"]}],
+ *     "unmatched": []
+ *   }
+ * - messages end with the delimiter, a null byte by default as XMLSocket uses
+ * - the greeting is sent on connecting, then the transcript is played like a WebSocket transcript
+ * - after that each message is answered by the first rule it matches. match is a substring, or a
+ *   regular expression with "regex": true whose groups can be used in replies as $1.
+ *   "close": true closes the connection after replying.
+ * - unmatched messages are answered with "unmatched"
+ * Policy requests are answered inline, using the archived socket policy for "host" if there is one.
+ */
+
+// Largest message accepted from a client
+const socketMessageLimit = 1024 * 1024
+
+// How long to wait for a policy request before greeting a client
+const socketPolicyWait = 250 * time.Millisecond
+
+// How a socket server is set up
+type SocketServerOptions struct {
+	// Rules file, relative paths are based on the root path
+	Rules string `json:"rules"`
+	// Host the game connects to, for its socket policy
+	Host string `json:"host,omitempty"`
+}
+
+// The contents of a rules file
+type socketRules struct {
+	Delimiter  string                     `json:"delimiter"`
+	Greeting   []string                   `json:"greeting"`
+	Transcript []websocketTranscriptEntry `json:"transcript"`
+	Rules      []socketRule               `json:"rules"`
+	Unmatched  []string                   `json:"unmatched"`
+}
+
+type socketRule struct {
+	Match   string   `json:"match"`
+	Regex   bool     `json:"regex"`
+	Reply   []string `json:"reply"`
+	Close   bool     `json:"close"`
+	pattern *regexp.Regexp
+}
+
+// A running socket server
+type socketServer struct {
+	port        string
+	options     SocketServerOptions
+	listener    net.Listener
+	connections int64
+}
+
+// Status of a socket server, as reported by the api
+type socketServerStatus struct {
+	Port        string `json:"port"`
+	Rules       string `json:"rules"`
+	Host        string `json:"host,omitempty"`
+	Source      string `json:"source"`
+	Running     bool   `json:"running"`
+	Connections int64  `json:"connections"`
+	Error       string `json:"error,omitempty"`
+}
+
+var socketServersMutex sync.Mutex
+
+// Running socket servers by port
+var socketServers = map[string]*socketServer{}
+
+// Socket servers started through the api, by port. They last until stopped or the proxy exits.
+var apiSocketServers = map[string]SocketServerOptions{}
+
+// Socket servers that failed to start, by port
+var socketServerErrors = map[string]string{}
+
+// Starts and stops socket servers to match the settings and those started through the api
+func syncSocketServers(settings *ServerSettings) {
+	socketServersMutex.Lock()
+	defer socketServersMutex.Unlock()
+
+	wanted := map[string]SocketServerOptions{}
+	for port, options := range settings.SocketServers {
+		wanted[port] = options
+	}
+	for port, options := range apiSocketServers {
+		wanted[port] = options
+	}
+	for port, server := range socketServers {
+		if options, ok := wanted[port]; !ok || options != server.options {
+			server.listener.Close()
+			delete(socketServers, port)
+			fmt.Printf("[Sockets] Stopped socket server on port %s\n", port)
+		}
+	}
+	for port := range socketServerErrors {
+		if _, ok := wanted[port]; !ok {
+			delete(socketServerErrors, port)
+		}
+	}
+	for port, options := range wanted {
+		if _, ok := socketServers[port]; ok {
+			continue
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			fmt.Printf("[Sockets] Failed to start socket server on port %s: %s\n", port, err)
+			socketServerErrors[port] = err.Error()
+			continue
+		}
+		delete(socketServerErrors, port)
+		server := &socketServer{port: port, options: options, listener: listener}
+		socketServers[port] = server
+		fmt.Printf("[Sockets] Started socket server on port %s with %s\n", port, options.Rules)
+		go server.serve()
+	}
+}
+
+// Returns the options of the socket server running on a port, if there is one
+func runningSocketServer(port string) (SocketServerOptions, bool) {
+	socketServersMutex.Lock()
+	defer socketServersMutex.Unlock()
+	server, ok := socketServers[port]
+	if !ok {
+		return SocketServerOptions{}, false
+	}
+	return server.options, true
+}
+
+func (s *socketServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.connections, 1)
+		go serveEmulatedSocket(currentSettings(), conn, bufio.NewReader(conn), s.port, s.options)
+	}
+}
+
+// Plays the server's part on a connection until either side closes it
+func serveEmulatedSocket(settings *ServerSettings, conn net.Conn, reader *bufio.Reader, port string, options SocketServerOptions) {
+	defer conn.Close()
+	// Flash asks for a policy as soon as it connects, other clients may be waiting for the greeting
+	conn.SetReadDeadline(time.Now().Add(socketPolicyWait))
+	isPolicyRequest := isSocketPolicyRequest(reader)
+	conn.SetReadDeadline(time.Time{})
+	if isPolicyRequest {
+		serveSocketPolicy(settings, conn, reader, options.Host)
+		return
+	}
+	rules, err := loadSocketRules(settings, options.Rules)
+	if err != nil {
+		fmt.Printf("[Sockets] Error loading rules for port %s: %s\n", port, err)
+		return
+	}
+	fmt.Printf("[Sockets] Connection on port %s from %s\n", port, conn.RemoteAddr())
+
+	delimiter := rules.Delimiter[0]
+	send := func(data []byte) error {
+		if settings.VerboseLogging {
+			fmt.Printf("[Sockets] Port %s sent %q\n", port, data)
+		}
+		_, err := conn.Write(append(data, delimiter))
+		return err
+	}
+	sendAll := func(messages []string) error {
+		for _, message := range messages {
+			if err := send([]byte(message)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// Plays the transcript until it's the client's turn
+	next := 0
+	playTranscript := func() error {
+		for ; next < len(rules.Transcript) && rules.Transcript[next].From == "server"; next++ {
+			entry := rules.Transcript[next]
+			time.Sleep(parseOptionalDuration(entry.Delay))
+			data := []byte(entry.Data)
+			if entry.Binary {
+				data, _ = base64.StdEncoding.DecodeString(entry.Data)
+			}
+			if err := send(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if sendAll(rules.Greeting) != nil || playTranscript() != nil {
+		return
+	}
+	for {
+		message, err := readSocketMessage(reader, delimiter)
+		if err != nil {
+			return
+		}
+		if settings.VerboseLogging {
+			fmt.Printf("[Sockets] Port %s received %q\n", port, message)
+		}
+		if next < len(rules.Transcript) {
+			next++
+			if playTranscript() != nil {
+				return
+			}
+			continue
+		}
+		replies, close := rules.reply(message)
+		if replies == nil {
+			if settings.VerboseLogging {
+				fmt.Printf("[Sockets] No rule on port %s matched %q\n", port, message)
+			}
+			replies = rules.Unmatched
+		}
+		if sendAll(replies) != nil || close {
+			return
+		}
+	}
+}
+
+// Reads a message up to the delimiter, which isn't included
+func readSocketMessage(reader *bufio.Reader, delimiter byte) (string, error) {
+	message := []byte{}
+	for {
+		chunk, err := reader.ReadSlice(delimiter)
+		message = append(message, chunk...)
+		if len(message) > socketMessageLimit {
+			return "", fmt.Errorf("message is too large")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(message[:len(message)-1]), nil
+	}
+}
+
+// Returns the replies of the first rule matching a message and whether to close the connection
+// after them, or nil if no rule matches
+func (rules *socketRules) reply(message string) ([]string, bool) {
+	for _, rule := range rules.Rules {
+		if rule.pattern == nil {
+			if strings.Contains(message, rule.Match) {
+				return append([]string{}, rule.Reply...), rule.Close
+			}
+			continue
+		}
+		match := rule.pattern.FindStringSubmatchIndex(message)
+		if match == nil {
+			continue
+		}
+		replies := []string{}
+		for _, reply := range rule.Reply {
+			replies = append(replies, string(rule.pattern.ExpandString(nil, reply, message, match)))
+		}
+		return replies, rule.Close
+	}
+	return nil, false
+}
+
+func loadSocketRules(settings *ServerSettings, rulesPath string) (*socketRules, error) {
+	filePath, err := resolveSettingPath(settings.RootPath, rulesPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	rules := &socketRules{}
+	err = json.Unmarshal(data, rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filePath, err)
+	}
+	if rules.Delimiter == "" {
+		rules.Delimiter = "\x00"
+	}
+	if len(rules.Delimiter) != 1 {
+		return nil, fmt.Errorf("delimiter in %s must be a single byte", filePath)
+	}
+	for i := range rules.Rules {
+		if rules.Rules[i].Regex {
+			rules.Rules[i].pattern, err = regexp.Compile(rules.Rules[i].Match)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d in %s has an invalid match: %w", i, filePath, err)
+			}
+		}
+	}
+	for i, entry := range rules.Transcript {
+		if err := validateTranscriptEntry(entry); err != nil {
+			return nil, fmt.Errorf("transcript entry %d in %s %w", i, filePath, err)
+		}
+	}
+	return rules, nil
+}
+
+// Returns the status of every socket server, by port
+func socketServersReport(settings *ServerSettings) []socketServerStatus {
+	socketServersMutex.Lock()
+	defer socketServersMutex.Unlock()
+
+	report := []socketServerStatus{}
+	add := func(port string, options SocketServerOptions, source string) {
+		status := socketServerStatus{Port: port, Rules: options.Rules, Host: options.Host, Source: source, Error: socketServerErrors[port]}
+		if server, ok := socketServers[port]; ok {
+			status.Running = true
+			status.Connections = atomic.LoadInt64(&server.connections)
+		}
+		report = append(report, status)
+	}
+	for port, options := range apiSocketServers {
+		add(port, options, "api")
+	}
+	for port, options := range settings.SocketServers {
+		if _, ok := apiSocketServers[port]; !ok {
+			add(port, options, "settings")
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Port < report[j].Port
+	})
+	return report
+}
+
+// GET lists the socket servers. POST starts one from a body of {"port", "rules", "host"}, replacing
+// any already on the port. DELETE with ?port= stops one started through the api.
+func serveSocketsApi(w http.ResponseWriter, r *http.Request) {
+	settings := currentSettings()
+	switch r.Method {
+	case "GET":
+		writeJsonResponse(w, socketServersReport(settings), http.StatusOK)
+	case "POST":
+		if !checkApiRequest(w, r) {
+			return
+		}
+		body := struct {
+			Port string `json:"port"`
+			SocketServerOptions
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeJsonResponse(w, zipfs.SimpleResponseData{Message: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		problems := validateSocketServer(settings, "port", body.Port, body.SocketServerOptions)
+		if len(problems) > 0 {
+			writeJsonResponse(w, zipfs.SimpleResponseData{Message: problems.Error()}, http.StatusBadRequest)
+			return
+		}
+		socketServersMutex.Lock()
+		apiSocketServers[body.Port] = body.SocketServerOptions
+		socketServersMutex.Unlock()
+		syncSocketServers(settings)
+		writeJsonResponse(w, socketServersReport(settings), http.StatusOK)
+	case "DELETE":
+		if !checkApiRequest(w, r) {
+			return
+		}
+		port := r.URL.Query().Get("port")
+		socketServersMutex.Lock()
+		_, ok := apiSocketServers[port]
+		delete(apiSocketServers, port)
+		socketServersMutex.Unlock()
+		if !ok {
+			writeJsonResponse(w, zipfs.SimpleResponseData{Message: fmt.Sprintf("No socket server was started on port %q through the api", port)}, http.StatusNotFound)
+			return
+		}
+		syncSocketServers(settings)
+		writeJsonResponse(w, socketServersReport(settings), http.StatusOK)
+	default:
+		http.Error(w, "GET, POST or DELETE request expected.", http.StatusMethodNotAllowed)
+	}
+}
+
+// Checks a socket server, returning every problem found
+func validateSocketServer(settings *ServerSettings, key string, port string, options SocketServerOptions) SettingsErrors {
+	problems := SettingsErrors{}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		problems = append(problems, SettingError{Key: key, Message: fmt.Sprintf("invalid port %q, must be a number from 1 to 65535", port)})
+	}
+	for _, portKey := range portSettingsInUse(settings) {
+		if port == settingField(settings, portKey).String() {
+			problems = append(problems, SettingError{Key: key, Message: fmt.Sprintf("port %s is already used by %s", port, portKey)})
+		}
+	}
+	if options.Rules == "" {
+		problems = append(problems, SettingError{Key: key, Message: "missing rules file"})
+	} else if _, err := loadSocketRules(settings, options.Rules); err != nil {
+		problems = append(problems, SettingError{Key: key, Message: err.Error()})
+	}
+	return problems
+}
+
+// Checks the socket servers, returning every problem found
+func validateSocketServers(settings *ServerSettings) SettingsErrors {
+	problems := SettingsErrors{}
+	ports := []string{}
+	for port := range settings.SocketServers {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		problems = append(problems, validateSocketServer(settings, "socketServers."+port, port, settings.SocketServers[port])...)
+	}
+	return problems
+}
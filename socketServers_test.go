@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSocketRules = `{
+	"greeting": ["<ready/>"],
+	"transcript": [{"from": "client", "data": "<hello/>"}, {"from": "server", "data": "<welcome/>"}],
+	"rules": [
+		{"match": "<login name='(\\w+)'/>", "regex": true, "reply": ["<logOK name='$1'/>"]},
+		{"match": "<quit/>", "reply": ["<bye/>"], "close": true}
+	],
+	"unmatched": ["<error/>"]
+}`
+
+// Writes a rules file, returning its path
+func writeTestSocketRules(t *testing.T, rules string) string {
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(rulesPath, []byte(rules), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rulesPath
+}
+
+// Returns a port nothing is listening on
+func freeTestPort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func expectTestSocketMessage(t *testing.T, reader *bufio.Reader, expected string) {
+	t.Helper()
+	message, err := readSocketMessage(reader, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != expected {
+		t.Errorf("expected message %s, got %s", expected, message)
+	}
+}
+
+func TestEmulatedSocket(t *testing.T) {
+	settings := testServerSettings
+	setup(&settings)
+	rulesPath := writeTestSocketRules(t, testSocketRules)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveEmulatedSocket(&settings, server, bufio.NewReader(server), "9339", SocketServerOptions{Rules: rulesPath})
+	reader := bufio.NewReader(client)
+
+	expectTestSocketMessage(t, reader, "<ready/>")
+	client.Write([]byte("<hello/>\x00"))
+	expectTestSocketMessage(t, reader, "<welcome/>")
+	client.Write([]byte("<login name='player'/>\x00"))
+	expectTestSocketMessage(t, reader, "<logOK name='player'/>")
+	client.Write([]byte("<move/>\x00"))
+	expectTestSocketMessage(t, reader, "<error/>")
+	client.Write([]byte("<quit/>\x00"))
+	expectTestSocketMessage(t, reader, "<bye/>")
+	if _, err := reader.ReadByte(); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
+
+func TestEmulatedSocketPolicy(t *testing.T) {
+	settings := testServerSettings
+	settings.AllowCrossDomain = true
+	setup(&settings)
+	rulesPath := writeTestSocketRules(t, testSocketRules)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveEmulatedSocket(&settings, server, bufio.NewReader(server), "9339", SocketServerOptions{Rules: rulesPath})
+	go client.Write([]byte(socketPolicyRequest + "\x00"))
+	policy, err := readSocketMessage(bufio.NewReader(client), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(policy, `to-ports="*"`) {
+		t.Errorf("expected a socket policy, got %s", policy)
+	}
+}
+
+func TestLoadSocketRulesChecksTranscript(t *testing.T) {
+	settings := testServerSettings
+	setup(&settings)
+
+	for entry, expected := range map[string]string{
+		`{"from": "server", "data": "<hi/>", "delay": "soon"}`:      `transcript entry 1 in`,
+		`{"from": "server", "data": "not base64!", "binary": true}`: `invalid base64 data`,
+		`{"from": "server", "data": "<hi/>", "delay": "-5ms"}`:      `invalid delay "-5ms"`,
+		`{"from": "browser", "data": "<hi/>"}`:                      `must be from client or server`,
+		`{"from": "server", "data": "PGhpLz4=", "binary": true}`:    ``,
+		`{"from": "server", "data": "<hi/>", "delay": "100ms"}`:     ``,
+	} {
+		rulesPath := writeTestSocketRules(t, `{"transcript": [{"from": "client", "data": "<hello/>"}, `+entry+`]}`)
+		_, err := loadSocketRules(&settings, rulesPath)
+		if expected == "" {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %s", entry, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected an error containing %s, got %v", entry, expected, err)
+		}
+	}
+}
+
+func TestSocketsApi(t *testing.T) {
+	handler := setupTestApi(t)
+	rulesPath := writeTestSocketRules(t, testSocketRules)
+	port := freeTestPort(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, makeJsonRequest("POST", "http://127.0.0.1/fpProxy/api/sockets", bytes.NewBufferString(`{"port": "`+port+`", "rules": "`+jsonEscape(rulesPath)+`"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	report := []socketServerStatus{}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if len(report) != 1 || !report[0].Running || report[0].Source != "api" {
+		t.Errorf("expected a running api socket server, got %+v", report)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTestSocketMessage(t, bufio.NewReader(conn), "<ready/>")
+	conn.Close()
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "http://127.0.0.1/fpProxy/api/sockets?port="+port, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:"+port); err == nil {
+		t.Errorf("expected the socket server to be stopped")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, makeJsonRequest("POST", "http://127.0.0.1/fpProxy/api/sockets", bytes.NewBufferString(`{"port": "`+port+`", "rules": "missing.json"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code 400 for a missing rules file, got %d", w.Code)
+	}
+}
+
+func TestValidateSocketServerPorts(t *testing.T) {
+	rulesPath := writeTestSocketRules(t, testSocketRules)
+	settings := testServerSettings
+	settings.SocksPort = "1080"
+	settings.ReverseProxyPort = "8080"
+	settings.EnableSocketPolicyServer = true
+	settings.SocketPolicyPort = "843"
+
+	for _, port := range []string{"1080", "8080", "843"} {
+		problems := validateSocketServer(&settings, "socketServers."+port, port, SocketServerOptions{Rules: rulesPath})
+		if len(problems) != 1 || !strings.Contains(problems[0].Message, "already used") {
+			t.Errorf("port %s: expected a port conflict, got %v", port, problems)
+		}
+	}
+	if problems := validateSocketServer(&settings, "socketServers.9000", "9000", SocketServerOptions{Rules: rulesPath}); len(problems) != 0 {
+		t.Errorf("expected a free port to be accepted, got %v", problems)
+	}
+}
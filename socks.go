@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/** SOCKS
+ * Some plugins and projectors only support SOCKS proxies, so a SOCKS5 listener can be started on
+ * socksPort. Only CONNECT without authentication is supported. Each connection is handled by what
+ * it's connecting to, or the first thing it sends:
+ * - a port with an emulated socket server goes to it, see socketServers.go
+ * - a socket policy request is answered, with the archived policy for the host if there is one
+ * - HTTP is read request by request and sent through handleRequest
+ * - TLS is passed to the proxy port as a CONNECT, so it's decrypted with the usual certificate when
+ *   enableHttpsProxy is on, and refused when it's off
+ * Anything else is refused, the real servers are never connected to.
+ */
+
+const (
+	socksVersion        = 0x05
+	socksCommandConnect = 0x01
+	socksAddressIPv4    = 0x01
+	socksAddressDomain  = 0x03
+	socksAddressIPv6    = 0x04
+)
+
+// SOCKS5 reply codes
+const (
+	socksReplySucceeded           = 0x00
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+)
+
+// How long a client may take to finish the SOCKS handshake and send its first bytes
+const socksHandshakeTimeout = 10 * time.Second
+
+// Serves SOCKS5 on an address, proxyAddress is the HTTP proxy that TLS connections are passed to
+func listenSocks(address string, proxyAddress string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	fmt.Println("SOCKS Server started on", address)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSocksConn(conn, proxyAddress)
+	}
+}
+
+func serveSocksConn(conn net.Conn, proxyAddress string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	host, port, err := socksHandshake(conn, reader)
+	if err != nil {
+		fmt.Printf("[SOCKS] Handshake with %s failed: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	settings := currentSettings()
+	if settings.VerboseLogging {
+		fmt.Printf("[SOCKS] %s connecting to %s\n", conn.RemoteAddr(), net.JoinHostPort(host, port))
+	}
+
+	if options, ok := runningSocketServer(port); ok {
+		conn.SetDeadline(time.Time{})
+		serveEmulatedSocket(settings, conn, reader, port, options)
+		return
+	}
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	switch {
+	case isSocketPolicyRequest(reader):
+		serveSocketPolicy(settings, conn, reader, host)
+	case first[0] == 0x16:
+		// A TLS handshake record
+		tunnelSocksToProxy(conn, reader, proxyAddress, net.JoinHostPort(host, port))
+	case first[0] >= 'A' && first[0] <= 'Z':
+		serveSocksHttp(conn, reader, net.JoinHostPort(host, port))
+	default:
+		fmt.Printf("[SOCKS] Refusing %s, it isn't HTTP and no socket server is running on port %s\n", net.JoinHostPort(host, port), port)
+	}
+}
+
+// Negotiates the connection, returning the host and port the client wants to connect to
+func socksHandshake(conn net.Conn, reader *bufio.Reader) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", "", err
+	}
+	noAuth := false
+	for _, method := range methods {
+		noAuth = noAuth || method == 0x00
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, 0xFF})
+		return "", "", errors.New("client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, 0x00}); err != nil {
+		return "", "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return "", "", err
+	}
+	var host string
+	switch request[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAddressIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", "", err
+		}
+		host = net.IP(ip).String()
+	case socksAddressDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", "", err
+		}
+		host = string(domain)
+	default:
+		writeSocksReply(conn, socksReplyAddressNotSupported)
+		return "", "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(reader, portBytes); err != nil {
+		return "", "", err
+	}
+	if request[1] != socksCommandConnect {
+		writeSocksReply(conn, socksReplyCommandNotSupported)
+		return "", "", fmt.Errorf("unsupported command %d", request[1])
+	}
+	if err := writeSocksReply(conn, socksReplySucceeded); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))), nil
+}
+
+// Replies to a request, the bound address isn't meaningful so it's always 0.0.0.0:0
+func writeSocksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Reads HTTP requests off the connection and answers them with handleRequest until either side
+// closes it
+func serveSocksHttp(conn net.Conn, reader *bufio.Reader, target string) {
+	for {
+		r, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		// Make the request look like one sent to the HTTP proxy
+		setAbsoluteRequestURL(r, target)
+		r.RemoteAddr = conn.RemoteAddr().String()
+
+		_, resp := handleRequest(r, nil)
+		if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+			resp.TransferEncoding = []string{"chunked"}
+		}
+		resp.ProtoMajor, resp.ProtoMinor = 1, 1
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Printf("Error writing response to client: %s\n", err)
+			return
+		}
+		if r.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// Passes a connection to the HTTP proxy as a CONNECT to target
+func tunnelSocksToProxy(conn net.Conn, reader *bufio.Reader, proxyAddress string, target string) {
+	proxyConn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		fmt.Printf("[SOCKS] Error connecting to the proxy: %s\n", err)
+		return
+	}
+	defer proxyConn.Close()
+	_, err = fmt.Fprintf(proxyConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	if err != nil {
+		return
+	}
+	proxyReader := bufio.NewReader(proxyConn)
+	resp, err := http.ReadResponse(proxyReader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		fmt.Printf("[SOCKS] Error reading CONNECT response for %s: %s\n", target, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("[SOCKS] Proxy refused TLS to %s: %s\n", target, resp.Status)
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(proxyConn, reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, proxyReader)
+		done <- struct{}{}
+	}()
+	<-done
+}
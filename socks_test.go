@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// Opens a SOCKS connection to host:port, returning the client's side of it
+func dialTestSocks(t *testing.T, host string, port int) (net.Conn, *bufio.Reader) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go serveSocksConn(server, "127.0.0.1:0")
+
+	reader := bufio.NewReader(client)
+	client.Write([]byte{socksVersion, 1, 0x00})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(reader, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("expected no authentication to be accepted, got %v %v", reply, err)
+	}
+	request := []byte{socksVersion, socksCommandConnect, 0x00, socksAddressDomain, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, byte(port>>8), byte(port))
+	client.Write(request)
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(reader, reply); err != nil || reply[1] != socksReplySucceeded {
+		t.Fatalf("expected the connection to succeed, got %v %v", reply, err)
+	}
+	return client, reader
+}
+
+func TestSocksHttp(t *testing.T) {
+	settings := testServerSettings
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/example.com/test.txt": "success",
+	})
+
+	client, reader := dialTestSocks(t, "example.com", 80)
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("GET", "http://example.com/test.txt", nil)
+		go r.Write(client)
+		resp, err := http.ReadResponse(reader, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readTestResponse(t, resp)
+		if resp.StatusCode != http.StatusOK || string(body) != "success" {
+			t.Errorf("request %d: expected success, got %d %s", i, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestSocksEmulatedSocket(t *testing.T) {
+	settings := testServerSettings
+	setup(&settings)
+	rulesPath := writeTestSocketRules(t, testSocketRules)
+	port := freeTestPort(t)
+	socketServersMutex.Lock()
+	apiSocketServers[port] = SocketServerOptions{Rules: rulesPath}
+	socketServersMutex.Unlock()
+	syncSocketServers(&settings)
+	t.Cleanup(func() {
+		socketServersMutex.Lock()
+		delete(apiSocketServers, port)
+		socketServersMutex.Unlock()
+		syncSocketServers(&settings)
+	})
+
+	portNumber, _ := strconv.Atoi(port)
+	_, reader := dialTestSocks(t, "chat.example.com", portNumber)
+	expectTestSocketMessage(t, reader, "<ready/>")
+}
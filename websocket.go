@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+/** WebSockets
+ * The request/response flow in handleRequest can't hold a WebSocket open, so upgrades for hosts set
+ * in "websockets" (exact, or *. for any subdomain) are handled before it:
+ *   "websockets": {"game.example.com": {"path": "/socket", "mode": "echo"}}
+ * Modes:
+ * - echo: every message is sent straight back
+ * - replay: "messages" are sent once connected, "interval" apart
+ * - transcript: a capture file is played back, sending the server's messages and waiting for each
+ *   of the client's. The file is a list of {"from": "server" or "client", "data": "...",
+ *   "binary": true if data is base64, "delay": "100ms"}, relative paths are based on the root path.
+ * - passthrough: the connection is tunnelled to the live server, for use while curating
+ * wss:// connections are only decrypted when enableHttpsProxy is on. goproxy can only pass the
+ * upgrades it decrypts through, so CONNECTs to hosts with emulated endpoints are decrypted by the
+ * proxy itself instead, answering the upgrades like ws:// ones and anything else with handleRequest.
+ */
+
+const (
+	websocketModeEcho        = "echo"
+	websocketModeReplay      = "replay"
+	websocketModeTranscript  = "transcript"
+	websocketModePassthrough = "passthrough"
+)
+
+// Appended to the client's key to make the accept key, from RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	websocketOpContinuation = 0x0
+	websocketOpText         = 0x1
+	websocketOpBinary       = 0x2
+	websocketOpClose        = 0x8
+	websocketOpPing         = 0x9
+	websocketOpPong         = 0xA
+)
+
+// Largest message accepted from a client
+const websocketMessageLimit = 16 * 1024 * 1024
+
+// How a host's WebSockets are handled
+type WebsocketEndpoint struct {
+	Mode string `json:"mode"`
+	// Only handle connections to this path, any path when empty
+	Path       string   `json:"path,omitempty"`
+	Messages   []string `json:"messages,omitempty"`
+	Interval   string   `json:"interval,omitempty"`
+	Transcript string   `json:"transcript,omitempty"`
+}
+
+// A single message in a transcript
+type websocketTranscriptEntry struct {
+	From   string `json:"from"`
+	Data   string `json:"data"`
+	Binary bool   `json:"binary"`
+	Delay  string `json:"delay"`
+}
+
+// The server side of a WebSocket connection
+type websocketConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+}
+
+// Returns whether a request asks to upgrade to a WebSocket
+func isWebsocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the endpoint set for a WebSocket upgrade, if any
+func websocketEndpointFor(settings *ServerSettings, r *http.Request) (WebsocketEndpoint, bool) {
+	if !isWebsocketUpgrade(r) {
+		return WebsocketEndpoint{}, false
+	}
+	host, _ := splitHostPort(r.URL.Host)
+	patterns := []string{}
+	for pattern := range settings.Websockets {
+		patterns = append(patterns, pattern)
+	}
+	pattern := bestHostPattern(strings.ToLower(host), patterns)
+	if pattern == "" {
+		return WebsocketEndpoint{}, false
+	}
+	endpoint := settings.Websockets[pattern]
+	if endpoint.Path != "" && endpoint.Path != r.URL.Path {
+		return WebsocketEndpoint{}, false
+	}
+	return endpoint, true
+}
+
+// Returns whether a WebSocket should be tunnelled to the live server
+func isWebsocketPassthrough(settings *ServerSettings, r *http.Request) bool {
+	endpoint, ok := websocketEndpointFor(settings, r)
+	return ok && endpoint.Mode == websocketModePassthrough
+}
+
+// Returns whether a host, which may have a port, has WebSockets emulated rather than passed through
+func hasEmulatedWebsockets(settings *ServerSettings, host string) bool {
+	host, _ = splitHostPort(host)
+	patterns := []string{}
+	for pattern := range settings.Websockets {
+		patterns = append(patterns, pattern)
+	}
+	pattern := bestHostPattern(strings.ToLower(host), patterns)
+	return pattern != "" && settings.Websockets[pattern].Mode != websocketModePassthrough
+}
+
+// Takes over CONNECTs to hosts with emulated WebSockets, ahead of goproxy's own handling, so their
+// wss:// upgrades can be emulated
+func handleWebsocketConnects(proxy *goproxy.ProxyHttpServer, tlsConfigFor func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error)) {
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if !hasEmulatedWebsockets(currentSettings(), host) {
+			return nil, host
+		}
+		return &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: func(r *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			tlsConfig, err := tlsConfigFor(host, ctx)
+			if err != nil {
+				fmt.Printf("[WebSocket] Error creating certificate for %s: %s\n", host, err)
+				client.Close()
+				return
+			}
+			serveWebsocketTLS(client, host, tlsConfig)
+		}}, host
+	})
+}
+
+// Serves a CONNECT tunnel over TLS, emulating WebSockets and answering every other request with
+// handleRequest
+func serveWebsocketTLS(client net.Conn, host string, tlsConfig *tls.Config) {
+	_, err := client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+	if err != nil {
+		client.Close()
+		return
+	}
+	handler := newWebsocketHandler(http.HandlerFunc(serveHandledRequest))
+	server := &http.Server{Handler: http.AllowQuerySemicolons(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAbsoluteRequestURL(r, host)
+		handler.ServeHTTP(w, r)
+	}))}
+	// Returns once the connection is handed over, it's served until the client closes it
+	server.Serve(&singleConnListener{conn: tls.Server(client, tlsConfig)})
+}
+
+// A listener giving out one connection, for serving a connection that's already been accepted
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn == nil {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Emulates the WebSockets set in the settings, passing everything else through to next
+func newWebsocketHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := currentSettings()
+		endpoint, ok := websocketEndpointFor(settings, r)
+		if !ok || !r.URL.IsAbs() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if endpoint.Mode == websocketModePassthrough {
+			passWebsocketThrough(settings, w, r)
+			return
+		}
+		serveWebsocketEmulation(settings, w, r, endpoint)
+	})
+}
+
+// Tunnels a ws:// connection to the live server. goproxy can do this too, but it goes on to send
+// the request a second time once the tunnel closes.
+func passWebsocketThrough(settings *ServerSettings, w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Host
+	if _, port := splitHostPort(address); port == "" {
+		address += ":80"
+	}
+	target, err := net.DialTimeout("tcp", address, onlineRequestTimeout)
+	if err != nil {
+		fmt.Printf("[WebSocket] Error connecting to %s: %s\n", address, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSockets not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		fmt.Printf("[WebSocket] Error taking over connection for %s: %s\n", r.URL, err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Printf("[WebSocket] Passing %s through\n", r.URL)
+	applySitelockHeaders(settings, r)
+	r.Header.Del("Proxy-Connection")
+	r.Header.Del("Proxy-Authorization")
+	if err := r.Write(target); err != nil {
+		fmt.Printf("[WebSocket] Error sending handshake to %s: %s\n", address, err)
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, rw.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Accepts the upgrade and plays the endpoint's part until the client disconnects
+func serveWebsocketEmulation(settings *ServerSettings, w http.ResponseWriter, r *http.Request, endpoint WebsocketEndpoint) {
+	var transcript []websocketTranscriptEntry
+	if endpoint.Mode == websocketModeTranscript {
+		var err error
+		transcript, err = loadWebsocketTranscript(settings, endpoint.Transcript)
+		if err != nil {
+			fmt.Printf("[WebSocket] Error loading transcript for %s: %s\n", r.URL, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ws, err := acceptWebsocket(w, r)
+	if err != nil {
+		fmt.Printf("[WebSocket] Error accepting %s: %s\n", r.URL, err)
+		return
+	}
+	defer ws.Close()
+	fmt.Printf("[WebSocket] Emulating %s (%s)\n", r.URL, endpoint.Mode)
+
+	switch endpoint.Mode {
+	case websocketModeEcho:
+		for {
+			opcode, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if ws.WriteMessage(opcode, data) != nil {
+				return
+			}
+		}
+	case websocketModeReplay:
+		interval := parseOptionalDuration(endpoint.Interval)
+		for i, message := range endpoint.Messages {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			if ws.WriteMessage(websocketOpText, []byte(message)) != nil {
+				return
+			}
+		}
+	case websocketModeTranscript:
+		for _, entry := range transcript {
+			if entry.From == "client" {
+				_, data, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				if settings.VerboseLogging && string(data) != entry.Data {
+					fmt.Printf("[WebSocket] Client sent %q, transcript expected %q\n", data, entry.Data)
+				}
+				continue
+			}
+			time.Sleep(parseOptionalDuration(entry.Delay))
+			opcode, data := byte(websocketOpText), []byte(entry.Data)
+			if entry.Binary {
+				opcode = websocketOpBinary
+				data, _ = base64.StdEncoding.DecodeString(entry.Data)
+			}
+			if ws.WriteMessage(opcode, data) != nil {
+				return
+			}
+		}
+	}
+	// Nothing left to send, keep the connection open until the client is done with it
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// Returns a duration already checked by validateWebsockets or loadWebsocketTranscript, or 0 if
+// it's empty
+func parseOptionalDuration(value string) time.Duration {
+	duration, _ := time.ParseDuration(value)
+	return duration
+}
+
+func loadWebsocketTranscript(settings *ServerSettings, transcriptPath string) ([]websocketTranscriptEntry, error) {
+	filePath, err := resolveSettingPath(settings.RootPath, transcriptPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	transcript := []websocketTranscriptEntry{}
+	err = json.Unmarshal(data, &transcript)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filePath, err)
+	}
+	for i, entry := range transcript {
+		if err := validateTranscriptEntry(entry); err != nil {
+			return nil, fmt.Errorf("entry %d of %s %w", i, filePath, err)
+		}
+	}
+	return transcript, nil
+}
+
+// Checks a transcript entry can be replayed, for WebSocket transcripts and socket server rules
+func validateTranscriptEntry(entry websocketTranscriptEntry) error {
+	if entry.From != "client" && entry.From != "server" {
+		return errors.New("must be from client or server")
+	}
+	if entry.Binary {
+		if _, err := base64.StdEncoding.DecodeString(entry.Data); err != nil {
+			return fmt.Errorf("has invalid base64 data: %w", err)
+		}
+	}
+	if entry.Delay != "" {
+		if delay, err := time.ParseDuration(entry.Delay); err != nil || delay < 0 {
+			return fmt.Errorf("has invalid delay %q, must be a duration such as 100ms", entry.Delay)
+		}
+	}
+	return nil
+}
+
+// Completes the opening handshake and takes over the connection
+func acceptWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "Unsupported WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("missing key or unsupported version")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSockets not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n"
+	// Browsers drop the connection if none of the protocols they offered is picked
+	if protocols := r.Header.Get("Sec-WebSocket-Protocol"); protocols != "" {
+		response += "Sec-WebSocket-Protocol: " + strings.TrimSpace(strings.Split(protocols, ",")[0]) + "\r\n"
+	}
+	response += "\r\n"
+	_, err = rw.WriteString(response)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocketConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// Reads a single frame, unmasking it if needed
+func (ws *websocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(ws.reader, header); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err = io.ReadFull(ws.reader, extended); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err = io.ReadFull(ws.reader, extended); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > websocketMessageLimit {
+		err = fmt.Errorf("frame of %d bytes is too large", length)
+		return
+	}
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err = io.ReadFull(ws.reader, mask); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.reader, payload); err != nil {
+		return
+	}
+	for i := range mask {
+		for j := i; j < len(payload); j += 4 {
+			payload[j] ^= mask[i]
+		}
+	}
+	return
+}
+
+// Reads the next text or binary message, answering any control frames on the way.
+// Returns io.EOF once the client closes the connection.
+func (ws *websocketConn) ReadMessage() (byte, []byte, error) {
+	var messageOpcode byte
+	var message []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch opcode {
+		case websocketOpPing:
+			if err := ws.writeFrame(websocketOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case websocketOpPong:
+			continue
+		case websocketOpClose:
+			return 0, nil, io.EOF
+		case websocketOpContinuation:
+		default:
+			messageOpcode = opcode
+		}
+		message = append(message, payload...)
+		if len(message) > websocketMessageLimit {
+			return 0, nil, fmt.Errorf("message is too large")
+		}
+		if fin {
+			return messageOpcode, message, nil
+		}
+	}
+}
+
+// Sends a whole message in a single frame
+func (ws *websocketConn) WriteMessage(opcode byte, data []byte) error {
+	return ws.writeFrame(opcode, data)
+}
+
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	_, err := ws.conn.Write(append(frame, payload...))
+	return err
+}
+
+// Sends a close frame and closes the connection
+func (ws *websocketConn) Close() error {
+	ws.writeFrame(websocketOpClose, []byte{0x03, 0xE8})
+	return ws.conn.Close()
+}
+
+// Checks the WebSocket endpoints, returning every problem found
+func validateWebsockets(settings *ServerSettings) SettingsErrors {
+	problems := SettingsErrors{}
+	patterns := []string{}
+	for pattern := range settings.Websockets {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		key := "websockets." + pattern
+		endpoint := settings.Websockets[pattern]
+		if problem := validateHostPattern(pattern); problem != "" {
+			problems = append(problems, SettingError{Key: key, Message: problem})
+		}
+		switch endpoint.Mode {
+		case websocketModeEcho, websocketModeReplay, websocketModePassthrough:
+		case websocketModeTranscript:
+			if endpoint.Transcript == "" {
+				problems = append(problems, SettingError{Key: key + ".transcript", Message: "a transcript file is needed for transcript mode"})
+			} else if filePath, err := resolveSettingPath(settings.RootPath, endpoint.Transcript); err != nil {
+				problems = append(problems, SettingError{Key: key + ".transcript", Message: err.Error()})
+			} else if _, err := os.Stat(filePath); err != nil {
+				problems = append(problems, SettingError{Key: key + ".transcript", Message: fmt.Sprintf("%s does not exist", filePath)})
+			} else if _, err := loadWebsocketTranscript(settings, endpoint.Transcript); err != nil {
+				problems = append(problems, SettingError{Key: key + ".transcript", Message: err.Error()})
+			}
+		default:
+			problems = append(problems, SettingError{Key: key + ".mode", Message: fmt.Sprintf("invalid mode %q, must be echo, replay, transcript or passthrough", endpoint.Mode)})
+		}
+		if endpoint.Interval != "" {
+			if _, err := time.ParseDuration(endpoint.Interval); err != nil {
+				problems = append(problems, SettingError{Key: key + ".interval", Message: fmt.Sprintf("invalid interval %q, must be a duration such as 100ms", endpoint.Interval)})
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Starts a proxy-like server emulating the given endpoints, anything else gets a 404
+func setupTestWebsockets(t *testing.T, websockets map[string]WebsocketEndpoint) string {
+	settings := testServerSettings
+	settings.Websockets = websockets
+	setup(&settings)
+	server := httptest.NewServer(newWebsocketHandler(http.NotFoundHandler()))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+// Opens a WebSocket through the proxy, returning the client's side of it
+func dialTestWebsocket(t *testing.T, proxyAddr string, url string) *websocketConn {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return upgradeTestWebsocket(t, conn, url, true)
+}
+
+// Sends the opening handshake on a connection, as a proxy request or straight to the site
+func upgradeTestWebsocket(t *testing.T, conn net.Conn, url string, proxied bool) *websocketConn {
+	r, _ := http.NewRequest("GET", url, nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Protocol", "chat, superchat")
+	write := r.Write
+	if proxied {
+		write = r.WriteProxy
+	}
+	if err := write(conn); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status code 101, got %d", resp.StatusCode)
+	}
+	// Example key and accept key from RFC 6455
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept key %s", accept)
+	}
+	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != "chat" {
+		t.Errorf("expected first protocol to be picked, got %s", protocol)
+	}
+	return &websocketConn{conn: conn, reader: reader}
+}
+
+// Sends a masked frame, as clients must
+func writeTestWebsocketFrame(t *testing.T, ws *websocketConn, opcode byte, payload string) {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opcode, 0x80 | 126, 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	if _, err := ws.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectTestWebsocketMessage(t *testing.T, ws *websocketConn, opcode byte, expected string) {
+	t.Helper()
+	gotOpcode, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotOpcode != opcode || string(data) != expected {
+		t.Errorf("expected message %q (opcode %d), got %q (opcode %d)", expected, opcode, data, gotOpcode)
+	}
+}
+
+func TestWebsocketEcho(t *testing.T) {
+	proxyAddr := setupTestWebsockets(t, map[string]WebsocketEndpoint{
+		"*.example.com": {Mode: websocketModeEcho, Path: "/socket"},
+	})
+	ws := dialTestWebsocket(t, proxyAddr, "http://game.example.com/socket")
+
+	writeTestWebsocketFrame(t, ws, websocketOpText, "hello")
+	expectTestWebsocketMessage(t, ws, websocketOpText, "hello")
+	writeTestWebsocketFrame(t, ws, websocketOpPing, "ping")
+	_, opcode, payload, err := ws.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != websocketOpPong || string(payload) != "ping" {
+		t.Errorf("expected pong, got opcode %d with %q", opcode, payload)
+	}
+}
+
+func TestWebsocketEmulatedOverTLS(t *testing.T) {
+	settings := testServerSettings
+	settings.Websockets = map[string]WebsocketEndpoint{
+		"game.example.com": {Mode: websocketModeEcho, Path: "/socket"},
+	}
+	setup(&settings)
+	setupTestZipServer(t, map[string]string{
+		"content/game.example.com/page.html": "secure page",
+	})
+	proxy := goproxy.NewProxyHttpServer()
+	handleWebsocketConnects(proxy, goproxy.TLSConfigFromCA(&goproxy.GoproxyCa))
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysReject)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connect, _ := http.NewRequest("CONNECT", "http://game.example.com:443", nil)
+	connect.Host = "game.example.com:443"
+	connect.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the CONNECT to be accepted, got status code %d", resp.StatusCode)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "game.example.com", InsecureSkipVerify: true})
+	ws := upgradeTestWebsocket(t, tlsConn, "https://game.example.com/socket", false)
+	writeTestWebsocketFrame(t, ws, websocketOpText, "hello")
+	expectTestWebsocketMessage(t, ws, websocketOpText, "hello")
+
+	// Other requests to the host are still served as usual
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err = client.Get("https://game.example.com/page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readTestResponse(t, resp); string(body) != "secure page" {
+		t.Errorf("expected the page from the GameZIP, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestWebsocketReplay(t *testing.T) {
+	proxyAddr := setupTestWebsockets(t, map[string]WebsocketEndpoint{
+		"game.example.com": {Mode: websocketModeReplay, Messages: []string{"welcome", "room 1"}, Interval: "10ms"},
+	})
+	ws := dialTestWebsocket(t, proxyAddr, "http://game.example.com/socket")
+
+	expectTestWebsocketMessage(t, ws, websocketOpText, "welcome")
+	expectTestWebsocketMessage(t, ws, websocketOpText, "room 1")
+}
+
+func TestWebsocketTranscript(t *testing.T) {
+	transcriptPath := filepath.Join(t.TempDir(), "capture.json")
+	err := os.WriteFile(transcriptPath, []byte(`[
+		{"from": "server", "data": "hello"},
+		{"from": "client", "data": "login"},
+		{"from": "server", "data": "AAEC", "binary": true, "delay": "10ms"}
+	]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := setupTestWebsockets(t, map[string]WebsocketEndpoint{
+		"game.example.com": {Mode: websocketModeTranscript, Transcript: transcriptPath},
+	})
+	ws := dialTestWebsocket(t, proxyAddr, "http://game.example.com/socket")
+
+	expectTestWebsocketMessage(t, ws, websocketOpText, "hello")
+	writeTestWebsocketFrame(t, ws, websocketOpText, "login")
+	expectTestWebsocketMessage(t, ws, websocketOpBinary, "\x00\x01\x02")
+}
+
+func TestValidateWebsocketsTranscriptDelay(t *testing.T) {
+	transcriptPath := filepath.Join(t.TempDir(), "capture.json")
+	err := os.WriteFile(transcriptPath, []byte(`[{"from": "server", "data": "hello", "delay": "soon"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &ServerSettings{RootPath: cwd, Websockets: map[string]WebsocketEndpoint{
+		"game.example.com": {Mode: websocketModeTranscript, Transcript: transcriptPath},
+	}}
+
+	problems := validateWebsockets(settings)
+	if len(problems) != 1 || problems[0].Key != "websockets.game.example.com.transcript" {
+		t.Errorf("expected a problem with the transcript's delay, got %v", problems)
+	}
+}
+
+func TestWebsocketNotEmulated(t *testing.T) {
+	proxyAddr := setupTestWebsockets(t, map[string]WebsocketEndpoint{
+		"game.example.com": {Mode: websocketModeEcho, Path: "/socket"},
+	})
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r, _ := http.NewRequest("GET", "http://game.example.com/other", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.WriteProxy(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected other paths to be passed on, got status code %d", resp.StatusCode)
+	}
+}
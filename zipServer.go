@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/FlashpointProject/zipfs"
+)
+
+/** Zip server
+ * zipfs takes its settings once, when the server is made, so the zip server is rebuilt whenever one
+ * of them changes. The zips mounted on the old server are mounted again on the new one before it's
+ * swapped in. Requests already being served finish on the old server, and its zips are unmounted,
+ * closing them, once the last of those requests is done. Mounts wait for a rebuild to finish, so
+ * none are lost in between.
+ */
+
+// A zip server that's rebuilt when the settings it was made with change
+type reloadableZipServer struct {
+	mutex    sync.RWMutex
+	handler  *zipHandler
+	settings *ServerSettings
+}
+
+// A zipfs server and the requests it's serving
+type zipHandler struct {
+	http.Handler
+	requests sync.WaitGroup
+	// Closed once the server is replaced and its zips are unmounted
+	closed chan struct{}
+}
+
+// Makes a zip server from the settings
+func newZipServer(settings *ServerSettings) *reloadableZipServer {
+	return &reloadableZipServer{handler: newZipHandler(settings), settings: settings}
+}
+
+func newZipHandler(settings *ServerSettings) *zipHandler {
+	handler := zipfs.EmptyFileServer(
+		settings.ApiPrefix,
+		"",
+		settings.VerboseLogging,
+		settings.ExtIndexTypes,
+		settings.GameDataPath,
+		settings.PhpCgiPath,
+		settings.ExtMimeTypes,
+		settings.OverridePaths,
+		settings.LegacyHTDOCSPath,
+	)
+	return &zipHandler{Handler: handler, closed: make(chan struct{})}
+}
+
+// Returns whether any setting the zip server was made with differs
+func zipSettingsChanged(a *ServerSettings, b *ServerSettings) bool {
+	return a.VerboseLogging != b.VerboseLogging ||
+		a.PhpCgiPath != b.PhpCgiPath ||
+		a.LegacyHTDOCSPath != b.LegacyHTDOCSPath ||
+		!reflect.DeepEqual(a.ExtIndexTypes, b.ExtIndexTypes) ||
+		!reflect.DeepEqual(a.ExtMimeTypes, b.ExtMimeTypes) ||
+		!reflect.DeepEqual(a.OverridePaths, b.OverridePaths)
+}
+
+func (s *reloadableZipServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.isMountRequest(r) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.handler.ServeHTTP(w, r)
+		return
+	}
+	// Counted while the lock is held, so a rebuild can't miss a request that's starting
+	s.mutex.RLock()
+	handler := s.handler
+	handler.requests.Add(1)
+	s.mutex.RUnlock()
+	defer handler.requests.Done()
+	handler.ServeHTTP(w, r)
+}
+
+// Returns whether a request changes the mounted zips
+func (s *reloadableZipServer) isMountRequest(r *http.Request) bool {
+	s.mutex.RLock()
+	apiPrefix := s.settings.ApiPrefix
+	s.mutex.RUnlock()
+	urlPath := path.Join("/", r.URL.Path)
+	for _, name := range []string{"mountzip", "unmountzip"} {
+		// zipfs ignores case when matching its api paths
+		if strings.EqualFold(urlPath, path.Join("/", apiPrefix, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rebuilds the zip server if the settings it was made with have changed, keeping its mounts
+func (s *reloadableZipServer) sync(settings *ServerSettings) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !zipSettingsChanged(s.settings, settings) {
+		s.settings = settings
+		return
+	}
+
+	mounted, err := listZipMounts(s.handler, s.settings.ApiPrefix)
+	if err != nil {
+		fmt.Printf("[Zip] Failed to list mounted zips, keeping the previous zip server: %s\n", err)
+		return
+	}
+	handler := newZipHandler(settings)
+	for _, filePath := range mounted {
+		err := postZipApi(handler, settings.ApiPrefix, "mountzip", filePath)
+		if err != nil {
+			fmt.Printf("[Zip] Failed to remount %s: %s\n", filePath, err)
+		}
+	}
+	previous, previousApiPrefix := s.handler, s.settings.ApiPrefix
+	s.handler = handler
+	s.settings = settings
+	fmt.Printf("[Zip] Zip server rebuilt with new settings, remounted %d zips\n", len(mounted))
+	go closeZipHandler(previous, previousApiPrefix, mounted)
+}
+
+// Unmounts a replaced zip server's zips once the requests it was serving are done
+func closeZipHandler(handler *zipHandler, apiPrefix string, mounted []string) {
+	handler.requests.Wait()
+	for _, filePath := range mounted {
+		err := postZipApi(handler, apiPrefix, "unmountzip", filePath)
+		if err != nil {
+			fmt.Printf("[Zip] Failed to unmount %s from the previous zip server: %s\n", filePath, err)
+		}
+	}
+	close(handler.closed)
+}
+
+// Returns the paths of the zips mounted on a zipfs server
+func listZipMounts(handler http.Handler, apiPrefix string) ([]string, error) {
+	r, err := http.NewRequest("GET", "http://127.0.0.1"+path.Join("/", apiPrefix, "listmountzip"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := serveInProcess(handler, r)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	var list zipfs.MountList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list.MountedZips, err
+}
+
+// Mounts or unmounts a zip on a zipfs server, name being mountzip or unmountzip
+func postZipApi(handler http.Handler, apiPrefix string, name string, filePath string) error {
+	body, err := json.Marshal(zipfs.Mount{FilePath: filePath})
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest("POST", "http://127.0.0.1"+path.Join("/", apiPrefix, name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp := serveInProcess(handler, r)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// Rebuilds the zip server to match the settings, unless it was replaced by one that can't be rebuilt
+func syncZipServer(settings *ServerSettings) {
+	if server, ok := zipServer.(*reloadableZipServer); ok {
+		server.sync(settings)
+	}
+}